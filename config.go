@@ -0,0 +1,211 @@
+package harbor_api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorHubConfigWithoutUrl = "error: the harbor config:%d in %s has no url"
+	ErrorHubConfigEmpty      = "error: the hub config:%s was empty"
+
+	// hubConfigReloadDelay merges the events of one write, such as the truncate and the following writes
+	hubConfigReloadDelay = time.Millisecond * 100
+)
+
+var (
+	envRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// HubConfig is the content of the hub config file in YAML or JSON, such as
+//
+//	harbors:
+//	- url: https://harbor.domain.com
+//	  admin: ${HARBOR_ADMIN}
+//	  passwordFile: /etc/harbor/password
+//	  mirrors:
+//	  - https://harbor-hk.domain.com
+//	- url: https://harbor-hk.domain.com
+//	  admin: ${HARBOR_ADMIN}
+//	  passwordFile: /etc/harbor/password-hk
+type HubConfig struct {
+	Harbors []Config `json:"harbors"`
+}
+
+// LoadHubConfig reads the hub config file in YAML or JSON. The ${ENV} references of the decoded values were expanded,
+// and the PasswordFile, relative to the directory of the config file, was read into the Password.
+func LoadHubConfig(path string) ([]Config, error) {
+	cont, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// an empty file was usually being written, instead of removing all the harbors
+	if len(bytes.TrimSpace(cont)) == 0 {
+		return nil, fmt.Errorf(ErrorHubConfigEmpty, path)
+	}
+	hc := &HubConfig{}
+	// YAML was a superset of JSON, so that both of them were decoded by the json tags
+	if err = yaml.Unmarshal(cont, hc); err != nil {
+		return nil, err
+	}
+	for i := range hc.Harbors {
+		hc.Harbors[i].expandEnv()
+		if hc.Harbors[i].Url == "" {
+			return nil, fmt.Errorf(ErrorHubConfigWithoutUrl, i, path)
+		}
+		if hc.Harbors[i].PasswordFile == "" {
+			continue
+		}
+		password, err := ioutil.ReadFile(resolvePasswordFile(path, hc.Harbors[i].PasswordFile))
+		if err != nil {
+			return nil, err
+		}
+		hc.Harbors[i].Password = strings.TrimRight(string(password), "\r\n")
+	}
+	return hc.Harbors, nil
+}
+
+// resolvePasswordFile returns the password file of the config file at path, the relative ones were resolved by its directory
+func resolvePasswordFile(path, passwordFile string) string {
+	if filepath.IsAbs(passwordFile) {
+		return passwordFile
+	}
+	return filepath.Join(filepath.Dir(path), passwordFile)
+}
+
+// expandEnv expands the ${ENV} references of the string fields. They were expanded after decoding,
+// so that the values such as a password containing "#" or ": " were never parsed as YAML.
+func (c *Config) expandEnv() {
+	expand := func(s string) string {
+		return envRegexp.ReplaceAllStringFunc(s, func(m string) string {
+			return os.Getenv(envRegexp.FindStringSubmatch(m)[1])
+		})
+	}
+	c.Url = expand(c.Url)
+	c.Admin = expand(c.Admin)
+	c.Password = expand(c.Password)
+	c.PasswordFile = expand(c.PasswordFile)
+	for i := range c.Mirrors {
+		c.Mirrors[i] = expand(c.Mirrors[i])
+	}
+}
+
+// NewHubFromFile creates the hub by the config file, and reconciles it whenever the file changes until ctx was done
+func NewHubFromFile(ctx context.Context, path string) (HubInterface, error) {
+	c, err := LoadHubConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	h := NewHub(c)
+	if err = WatchHubConfig(ctx, path, h); err != nil {
+		// the watches of the harbors were already polling
+		if err := h.Close(); err != nil {
+			zaplogger.Sugar().Error(err)
+		}
+		return nil, err
+	}
+	return h, nil
+}
+
+// WatchHubConfig reloads the config file and reconciles the hub whenever the file changes, until ctx was done.
+// The directory of the file was watched instead of the file itself, since a mounted Kubernetes Secret or
+// ConfigMap was updated by swapping the symlinks. The directories of the password files were watched as well,
+// and re-synced after each reload, so that a rotated password was updated in place.
+// A config which fails to load was logged and skipped.
+func WatchHubConfig(ctx context.Context, path string, h HubInterface) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	// a config which fails to load only watches its own directory until the next reload
+	c, _ := LoadHubConfig(path)
+	if err = syncHubConfigDirs(watcher, dirs, path, c); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	go func() {
+		defer func() {
+			if err := watcher.Close(); err != nil {
+				zaplogger.Sugar().Error(err)
+			}
+		}()
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				zaplogger.Sugar().Errorw("hub config watcher error", "path", path, "err", err)
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if e.Op == fsnotify.Chmod {
+					continue
+				}
+				reload = time.After(hubConfigReloadDelay)
+			case <-reload:
+				reload = nil
+				c, err := LoadHubConfig(path)
+				if err != nil {
+					zaplogger.Sugar().Errorw("hub config reload failed", "path", path, "err", err)
+					continue
+				}
+				if err = syncHubConfigDirs(watcher, dirs, path, c); err != nil {
+					zaplogger.Sugar().Errorw("hub config watcher error", "path", path, "err", err)
+				}
+				if err = h.Reconcile(c); err != nil {
+					zaplogger.Sugar().Errorw("hub config reconcile failed", "path", path, "err", err)
+					continue
+				}
+				zaplogger.Sugar().Infow("hub config reloaded", "path", path, "harbors", h.List())
+			}
+		}
+	}()
+	return nil
+}
+
+// syncHubConfigDirs watches the directory of the config file and the directories of its password files,
+// and stops watching the directories which were no longer used
+func syncHubConfigDirs(watcher *fsnotify.Watcher, dirs map[string]bool, path string, c []Config) error {
+	desired := map[string]bool{filepath.Dir(path): true}
+	for _, v := range c {
+		if v.PasswordFile != "" {
+			desired[filepath.Dir(resolvePasswordFile(path, v.PasswordFile))] = true
+		}
+	}
+	for dir := range dirs {
+		if desired[dir] {
+			continue
+		}
+		// the directory may have been removed along with its watch
+		if err := watcher.Remove(dir); err != nil {
+			zaplogger.Sugar().Debugw("hub config watcher remove failed", "dir", dir, "err", err)
+		}
+		delete(dirs, dir)
+	}
+	for dir := range desired {
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+		dirs[dir] = true
+	}
+	return nil
+}
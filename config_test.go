@@ -0,0 +1,274 @@
+package harbor_api
+
+import (
+	"context"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadHubConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harbor-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "password"), []byte("pwd-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Setenv("HARBOR_API_TEST_ADMIN", "admin-from-env"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("HARBOR_API_TEST_ADMIN")
+	// a password which would break the YAML, or inject the mirrors, if it was expanded before decoding
+	password := "s3cr #et: \"q'\n  mirrors: [https://evil.domain.com]"
+	if err = os.Setenv("HARBOR_API_TEST_PASSWORD", password); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("HARBOR_API_TEST_PASSWORD")
+	if err = os.Setenv("HARBOR_API_TEST_MIRROR", "harbor-hk.domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("HARBOR_API_TEST_MIRROR")
+	tests := []struct {
+		name    string
+		content string
+		want    []Config
+		wantErr bool
+	}{
+		{
+			name: "TestLoadHubConfig_YAML",
+			content: `
+harbors:
+- url: https://harbor.domain.com
+  admin: ${HARBOR_API_TEST_ADMIN}
+  passwordFile: password
+- url: http://111.222.333.11:8863
+  admin: admin
+  password: pa$$word
+`,
+			want: []Config{
+				{Url: "https://harbor.domain.com", Admin: "admin-from-env", Password: "pwd-from-file", PasswordFile: "password"},
+				{Url: "http://111.222.333.11:8863", Admin: "admin", Password: "pa$$word"},
+			},
+		},
+		{
+			name:    "TestLoadHubConfig_JSON",
+			content: `{"harbors":[{"url":"https://harbor.domain.com","admin":"${HARBOR_API_TEST_ADMIN}","password":"pwd"}]}`,
+			want: []Config{
+				{Url: "https://harbor.domain.com", Admin: "admin-from-env", Password: "pwd"},
+			},
+		},
+		{
+			name: "TestLoadHubConfig_EnvNotParsed",
+			content: `
+harbors:
+- url: https://harbor.domain.com
+  admin: ${HARBOR_API_TEST_ADMIN}
+  password: ${HARBOR_API_TEST_PASSWORD}
+  mirrors:
+  - https://${HARBOR_API_TEST_MIRROR}
+`,
+			want: []Config{
+				{Url: "https://harbor.domain.com", Admin: "admin-from-env", Password: password, Mirrors: []string{"https://harbor-hk.domain.com"}},
+			},
+		},
+		{
+			name:    "TestLoadHubConfig_JSON_EnvNotParsed",
+			content: `{"harbors":[{"url":"https://harbor.domain.com","admin":"admin","password":"${HARBOR_API_TEST_PASSWORD}"}]}`,
+			want: []Config{
+				{Url: "https://harbor.domain.com", Admin: "admin", Password: password},
+			},
+		},
+		{
+			name:    "TestLoadHubConfig_WithoutUrl",
+			content: "harbors:\n- admin: admin\n",
+			wantErr: true,
+		},
+		{
+			name:    "TestLoadHubConfig_MissingPasswordFile",
+			content: "harbors:\n- url: harbor.domain.com\n  passwordFile: missing\n",
+			wantErr: true,
+		},
+		{
+			name:    "TestLoadHubConfig_Empty",
+			content: "\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "hub.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadHubConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadHubConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadHubConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// reconciledHub signals each Reconcile of the hub, so that the tests wait for the reloads of the config file
+type reconciledHub struct {
+	HubInterface
+	reconciled chan []Config
+}
+
+func newReconciledHub(ctx context.Context, t *testing.T, path string) *reconciledHub {
+	c, err := LoadHubConfig(path)
+	if err != nil {
+		t.Fatalf("LoadHubConfig() error = %v", err)
+	}
+	h := &reconciledHub{HubInterface: NewHub(c), reconciled: make(chan []Config, 10)}
+	if err = WatchHubConfig(ctx, path, h); err != nil {
+		t.Fatalf("WatchHubConfig() error = %v", err)
+	}
+	return h
+}
+
+func (h *reconciledHub) Reconcile(c []Config) error {
+	err := h.HubInterface.Reconcile(c)
+	h.reconciled <- c
+	return err
+}
+
+// wait waits for the reloads until done returns true
+func (h *reconciledHub) wait(t *testing.T, done func() bool) {
+	for !done() {
+		select {
+		case <-h.reconciled:
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("the hub config was not reloaded")
+		}
+	}
+}
+
+func TestNewHubFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harbor-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hub.yaml")
+	write := func(content string) {
+		// write and rename like the updates of a mounted Kubernetes Secret
+		if err := ioutil.WriteFile(path+".tmp", []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("harbors:\n- url: https://harbor-1.domain.com\n  password: pwd\n- url: https://harbor-2.domain.com\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, err := NewHubFromFile(ctx, path)
+	if err != nil {
+		t.Fatalf("NewHubFromFile() error = %v", err)
+	}
+	if got, want := hub.List(), []string{"https://harbor-1.domain.com", "https://harbor-2.domain.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hub.List() = %v, want %v", got, want)
+	}
+	if err = hub.Close(); err != nil {
+		t.Fatalf("hub.Close() error = %v", err)
+	}
+
+	// the reloads were observed by the Reconcile calls of the hub
+	h := newReconciledHub(ctx, t, path)
+	defer h.Close()
+	first, err := h.Get("harbor-1.domain.com")
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+
+	write("harbors:\n- url: https://harbor-1.domain.com\n  password: pwd2\n- url: https://harbor-3.domain.com\n")
+	want := []string{"https://harbor-1.domain.com", "https://harbor-3.domain.com"}
+	h.wait(t, func() bool {
+		return reflect.DeepEqual(h.List(), want)
+	})
+	got, err := h.Get("harbor-1.domain.com")
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+	if got != first {
+		t.Errorf("the changed credentials were not updated in place")
+	}
+	if _, password := got.(*harbor).credentials(); password != "pwd2" {
+		t.Errorf("harbor password = %v, want pwd2", password)
+	}
+
+	// the broken config was skipped, so that the next config reconciled after pwd2 was the one fixing it
+	write("harbors: [")
+	write("harbors:\n- url: https://harbor-1.domain.com\n  password: pwd3\n- url: https://harbor-3.domain.com\n")
+	for password := "pwd2"; password == "pwd2"; {
+		select {
+		case c := <-h.reconciled:
+			if password = c[0].Password; password != "pwd2" && password != "pwd3" {
+				t.Errorf("reconciled config = %v, want the fixed one", c)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("the hub config was not reloaded")
+		}
+	}
+	if got := h.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hub.List() = %v after a broken config, want %v", got, want)
+	}
+}
+
+func TestNewHubFromFile_PasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harbor-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the password file lives in another directory, like a Secret mounted apart from the config
+	secrets, err := ioutil.TempDir("", "harbor-api-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(secrets)
+	passwordFile := filepath.Join(secrets, "password")
+	writePassword := func(password string) {
+		if err := ioutil.WriteFile(passwordFile+".tmp", []byte(password+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(passwordFile+".tmp", passwordFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePassword("pwd")
+	path := filepath.Join(dir, "hub.yaml")
+	if err = ioutil.WriteFile(path, []byte("harbors:\n- url: https://harbor-1.domain.com\n  passwordFile: "+passwordFile+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newReconciledHub(ctx, t, path)
+	defer h.Close()
+	got, err := h.Get("harbor-1.domain.com")
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+	if _, password := got.(*harbor).credentials(); password != "pwd" {
+		t.Fatalf("harbor password = %v, want pwd", password)
+	}
+
+	// only the password file was rotated
+	writePassword("pwd2")
+	h.wait(t, func() bool {
+		_, password := got.(*harbor).credentials()
+		return password == "pwd2"
+	})
+	if now, err := h.Get("harbor-1.domain.com"); err != nil || now != got {
+		t.Errorf("the rotated password was not updated in place")
+	}
+}
@@ -0,0 +1,288 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	harbor_api "github.com/nevercase/harbor-api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorUnknownWorkloadKind = "error: unknown workload kind:%s"
+	ErrorUnknownStrategy     = "error: unknown update strategy:%s"
+
+	// AnnotationWatch opts a workload in, its value must be "true"
+	AnnotationWatch = "harbor.nevercase.io/watch"
+	// AnnotationStrategy chooses how a workload was rolled, StrategyRestart by default
+	AnnotationStrategy = "harbor.nevercase.io/update-strategy"
+	// AnnotationRestartedAt was set on the pod template by StrategyRestart, like `kubectl rollout restart`
+	AnnotationRestartedAt = "harbor.nevercase.io/restartedAt"
+
+	// StrategyRestart restarts the pods, so that the moved tag was pulled again with imagePullPolicy Always
+	StrategyRestart = "restart"
+	// StrategyPin pins the container image to the new digest, such as harbor.domain.com/project/repo:tag@sha256:xxx
+	StrategyPin = "pin"
+
+	defaultResyncPeriod = time.Second * 30
+)
+
+type Config struct {
+	// Namespace limits the scanned workloads, empty means all the namespaces
+	Namespace string
+	// ResyncPeriod is how often the workloads were scanned, 30s by default
+	ResyncPeriod time.Duration
+}
+
+// Controller scans the opted-in workloads, watches the images of their containers through the hub,
+// and patches their pod templates when a watched tag moves
+type Controller struct {
+	kubeClient   kubernetes.Interface
+	hub          harbor_api.HubInterface
+	namespace    string
+	resyncPeriod time.Duration
+
+	mu      sync.Mutex
+	watches map[string]*containerWatch
+}
+
+// containerWatch is the watch of one container of a workload
+type containerWatch struct {
+	workload  workload
+	container string
+	ref       harbor_api.Reference
+	image     string
+	strategy  string
+	w         watch.Interface
+}
+
+func NewController(kubeClient kubernetes.Interface, hub harbor_api.HubInterface, c Config) *Controller {
+	if c.ResyncPeriod <= 0 {
+		c.ResyncPeriod = defaultResyncPeriod
+	}
+	return &Controller{
+		kubeClient:   kubeClient,
+		hub:          hub,
+		namespace:    c.Namespace,
+		resyncPeriod: c.ResyncPeriod,
+		watches:      make(map[string]*containerWatch, 0),
+	}
+}
+
+// Run scans the workloads every ResyncPeriod until ctx was done, and then stops all the watches
+func (c *Controller) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := c.Sync(ctx); err != nil {
+			zaplogger.Sugar().Errorw("controller sync failed", "err", err)
+		}
+	}, c.resyncPeriod)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.watches {
+		v.w.Stop()
+		delete(c.watches, k)
+	}
+}
+
+// Sync scans the workloads once. It starts the watches of the new containers, restarts the ones
+// whose image or strategy has been changed, and stops the ones which were no longer opted in.
+func (c *Controller) Sync(ctx context.Context) error {
+	workloads, err := c.workloads(ctx)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, 0)
+	for _, wl := range workloads {
+		if wl.annotations[AnnotationWatch] != "true" {
+			continue
+		}
+		for _, container := range wl.template.Spec.Containers {
+			key := wl.key(container.Name)
+			c.mu.Lock()
+			cw, ok := c.watches[key]
+			unchanged := ok && cw.image == container.Image && cw.strategy == wl.strategy()
+			c.mu.Unlock()
+			if unchanged {
+				seen[key] = true
+				continue
+			}
+			if ok {
+				c.stop(key, cw)
+			}
+			started, err := c.watch(ctx, wl, container.Name, container.Image)
+			if err != nil {
+				zaplogger.Sugar().Errorw("controller watch failed", "workload", key, "image", container.Image, "err", err)
+				continue
+			}
+			if started == nil {
+				continue
+			}
+			seen[key] = true
+			c.mu.Lock()
+			c.watches[key] = started
+			c.mu.Unlock()
+			go c.handle(ctx, key, started)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.watches {
+		if !seen[k] {
+			v.w.Stop()
+			delete(c.watches, k)
+		}
+	}
+	return nil
+}
+
+// watch starts the watch of a container, it returns nil if the image was not a tag served by the hub
+func (c *Controller) watch(ctx context.Context, wl workload, containerName, image string) (*containerWatch, error) {
+	ref, err := harbor_api.ParseReference(image)
+	if err != nil || ref.Host == "" || ref.Tag == "" {
+		return nil, nil
+	}
+	h, err := c.hub.Get(ref.Url())
+	if err != nil {
+		return nil, nil
+	}
+	opt := ref.Option()
+	if opt.Sha256 == "" {
+		if opt.Sha256, err = c.currentDigest(ctx, wl, containerName); err != nil {
+			return nil, err
+		}
+	}
+	w, err := h.Watch(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &containerWatch{
+		workload:  wl,
+		container: containerName,
+		ref:       ref,
+		image:     image,
+		strategy:  wl.strategy(),
+		w:         w,
+	}, nil
+}
+
+// currentDigest returns the digest which the running pods of the workload have pulled for the container
+func (c *Controller) currentDigest(ctx context.Context, wl workload, containerName string) (string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(wl.selector)
+	if err != nil {
+		return "", err
+	}
+	pods, err := c.kubeClient.CoreV1().Pods(wl.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != containerName {
+				continue
+			}
+			if ref, err := harbor_api.ParseReference(status.ImageID); err == nil && ref.Digest != "" {
+				return ref.Digest, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (c *Controller) stop(key string, cw *containerWatch) {
+	cw.w.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watches[key] == cw {
+		delete(c.watches, key)
+	}
+}
+
+func (c *Controller) handle(ctx context.Context, key string, cw *containerWatch) {
+	// the closed watch would be started again by the next Sync
+	defer c.stop(key, cw)
+	for e := range cw.w.ResultChan() {
+		switch e.Type {
+		case watch.Modified:
+			change, ok := e.Object.(*harbor_api.ImageDigestChange)
+			if !ok {
+				continue
+			}
+			if err := c.rollout(ctx, key, cw, change); err != nil {
+				zaplogger.Sugar().Errorw("controller rollout failed", "workload", key, "image", change.Name, "err", err)
+				continue
+			}
+			zaplogger.Sugar().Infow("controller rolled out", "workload", key, "image", change.Name,
+				"sha256", change.Spec.Sha256, "previous", change.Spec.PreviousSha256)
+		case watch.Deleted, watch.Error:
+			zaplogger.Sugar().Infow("controller watch event", "workload", key, "type", e.Type)
+		}
+	}
+}
+
+// rollout patches the pod template of the workload by its strategy
+func (c *Controller) rollout(ctx context.Context, key string, cw *containerWatch, change *harbor_api.ImageDigestChange) error {
+	var template map[string]interface{}
+	image := ""
+	switch cw.strategy {
+	case StrategyRestart:
+		template = map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{
+					AnnotationRestartedAt: time.Now().Format(time.RFC3339),
+				},
+			},
+		}
+	case StrategyPin:
+		pinned := cw.ref
+		pinned.Digest = change.Spec.Sha256
+		image = pinned.String()
+		template = map[string]interface{}{
+			"spec": map[string]interface{}{
+				"containers": []map[string]string{
+					{"name": cw.container, "image": image},
+				},
+			},
+		}
+	default:
+		return fmt.Errorf(ErrorUnknownStrategy, cw.strategy)
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": template,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if image != "" {
+		// the pinned image was still watched by cw, there is no need to restart it at the next Sync.
+		// If the patch failed, the next Sync restarts it since the image of the workload was not the same.
+		c.mu.Lock()
+		if c.watches[key] == cw {
+			cw.image = image
+		}
+		c.mu.Unlock()
+	}
+	return c.patch(ctx, cw.workload, data)
+}
+
+func (c *Controller) patch(ctx context.Context, wl workload, data []byte) (err error) {
+	switch wl.kind {
+	case KindDeployment:
+		_, err = c.kubeClient.AppsV1().Deployments(wl.namespace).Patch(ctx, wl.name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	case KindStatefulSet:
+		_, err = c.kubeClient.AppsV1().StatefulSets(wl.namespace).Patch(ctx, wl.name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	case KindDaemonSet:
+		_, err = c.kubeClient.AppsV1().DaemonSets(wl.namespace).Patch(ctx, wl.name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf(ErrorUnknownWorkloadKind, wl.kind)
+	}
+	return err
+}
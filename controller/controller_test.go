@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	harbor_api "github.com/nevercase/harbor-api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHarbor returns a FakeWatcher for every watched image, so that the tests send the events
+type fakeHarbor struct {
+	harbor_api.HarborInterface
+
+	mu       sync.Mutex
+	watchers map[string]*watch.FakeWatcher
+	options  map[string]harbor_api.Option
+}
+
+func (h *fakeHarbor) Watch(opt harbor_api.Option) (watch.Interface, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w := watch.NewFake()
+	h.watchers[opt.ImageName()] = w
+	h.options[opt.ImageName()] = opt
+	return w, nil
+}
+
+func (h *fakeHarbor) watcher(imageName string) (*watch.FakeWatcher, harbor_api.Option) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.watchers[imageName], h.options[imageName]
+}
+
+type fakeHub struct {
+	harbor_api.HubInterface
+	harbors map[string]harbor_api.HarborInterface
+}
+
+func (h *fakeHub) Get(url string, opts ...harbor_api.GetOption) (harbor_api.HarborInterface, error) {
+	if t, ok := h.harbors[strings.TrimPrefix(url, harbor_api.HttpsPrefix)]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf(harbor_api.ErrorHarborUrlWasNotExisted, url)
+}
+
+const (
+	digestA = "sha256:27d6aa8f9d040c5e85c61a093ad2dc769e57440e8240c3294f47093e97d96c9a"
+	digestB = "sha256:4bc453b53cb3d914b45f4b250294236adba2c0e09ff6f03793949e7e39fd4cc1"
+	digestC = "sha256:6b0f5a8e3b9a1cd2e4f7081263c3a7e5d9b1f04a8c26e3d5b7f9a0c1e2d3f4a5"
+)
+
+func newTemplate(image string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "app"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: image}},
+		},
+	}
+}
+
+func TestController_Sync(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}}
+	kubeClient := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "restart", Annotations: map[string]string{AnnotationWatch: "true"}},
+			Spec:       appsv1.DeploymentSpec{Selector: selector, Template: newTemplate("harbor.domain.com/project-1/repo-1:latest")},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pin", Annotations: map[string]string{AnnotationWatch: "true", AnnotationStrategy: StrategyPin}},
+			Spec:       appsv1.StatefulSetSpec{Selector: selector, Template: newTemplate("harbor.domain.com/project-1/repo-2:v1")},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ignored"},
+			Spec:       appsv1.DaemonSetSpec{Selector: selector, Template: newTemplate("harbor.domain.com/project-1/repo-3:latest")},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "restart-0", Labels: map[string]string{"app": "app"}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name:    "app",
+				ImageID: "docker-pullable://harbor.domain.com/project-1/repo-1@" + digestA,
+			}}},
+		},
+	)
+	h := &fakeHarbor{watchers: make(map[string]*watch.FakeWatcher), options: make(map[string]harbor_api.Option)}
+	c := NewController(kubeClient, &fakeHub{harbors: map[string]harbor_api.HarborInterface{"harbor.domain.com": h}}, Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Sync(ctx); err != nil {
+		t.Fatalf("Controller.Sync() error = %v", err)
+	}
+	if w, _ := h.watcher("project-1/repo-3:latest"); w != nil {
+		t.Errorf("Controller.Sync() watched the workload which was not opted in")
+	}
+
+	w, opt := h.watcher("project-1/repo-1:latest")
+	if w == nil {
+		t.Fatalf("Controller.Sync() didn't watch the deployment")
+	}
+	if opt.Sha256 != digestA {
+		t.Errorf("Controller.Sync() Option.Sha256 = %v, want the digest of the running pod", opt.Sha256)
+	}
+	opt.Sha256 = digestB
+	w.Modify(harbor_api.NewImageDigestChange(opt, digestA))
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		d, err := kubeClient.AppsV1().Deployments("default").Get(ctx, "restart", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return d.Spec.Template.Annotations[AnnotationRestartedAt] != "", nil
+	}); err != nil {
+		t.Errorf("the deployment was not restarted, err:%v", err)
+	}
+
+	w, opt = h.watcher("project-1/repo-2:v1")
+	if w == nil {
+		t.Fatalf("Controller.Sync() didn't watch the statefulset")
+	}
+	opt.Sha256 = digestC
+	w.Modify(harbor_api.NewImageDigestChange(opt, ""))
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		s, err := kubeClient.AppsV1().StatefulSets("default").Get(ctx, "pin", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return s.Spec.Template.Spec.Containers[0].Image == "harbor.domain.com/project-1/repo-2:v1@"+digestC, nil
+	}); err != nil {
+		t.Errorf("the statefulset was not pinned, err:%v", err)
+	}
+
+	// the pinned image was still the same watch
+	if err := c.Sync(ctx); err != nil {
+		t.Fatalf("Controller.Sync() error = %v", err)
+	}
+	if got, _ := h.watcher("project-1/repo-2:v1"); got != w {
+		t.Errorf("Controller.Sync() restarted the watch of the pinned image")
+	}
+
+	// the watch was stopped once the workload opted out
+	if err := kubeClient.AppsV1().StatefulSets("default").Delete(ctx, "pin", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(ctx); err != nil {
+		t.Fatalf("Controller.Sync() error = %v", err)
+	}
+	if !w.IsStopped() {
+		t.Errorf("Controller.Sync() didn't stop the watch of the deleted workload")
+	}
+}
@@ -0,0 +1,3 @@
+// Package controller rolls the Kubernetes workloads whose images were watched in harbor,
+// once the digest of the watched tag changes
+package controller // import "github.com/nevercase/harbor-api/controller"
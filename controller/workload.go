@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+)
+
+// workload is the common part of the Deployments, StatefulSets and DaemonSets
+type workload struct {
+	kind        string
+	namespace   string
+	name        string
+	annotations map[string]string
+	selector    *metav1.LabelSelector
+	template    corev1.PodTemplateSpec
+}
+
+func (w workload) key(containerName string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", w.kind, w.namespace, w.name, containerName)
+}
+
+func (w workload) strategy() string {
+	if s := w.annotations[AnnotationStrategy]; s != "" {
+		return s
+	}
+	return StrategyRestart
+}
+
+func (c *Controller) workloads(ctx context.Context) ([]workload, error) {
+	res := make([]workload, 0)
+	deployments, err := c.kubeClient.AppsV1().Deployments(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range deployments.Items {
+		res = append(res, workload{
+			kind:        KindDeployment,
+			namespace:   v.Namespace,
+			name:        v.Name,
+			annotations: v.Annotations,
+			selector:    v.Spec.Selector,
+			template:    v.Spec.Template,
+		})
+	}
+	statefulSets, err := c.kubeClient.AppsV1().StatefulSets(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range statefulSets.Items {
+		res = append(res, workload{
+			kind:        KindStatefulSet,
+			namespace:   v.Namespace,
+			name:        v.Name,
+			annotations: v.Annotations,
+			selector:    v.Spec.Selector,
+			template:    v.Spec.Template,
+		})
+	}
+	daemonSets, err := c.kubeClient.AppsV1().DaemonSets(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range daemonSets.Items {
+		res = append(res, workload{
+			kind:        KindDaemonSet,
+			namespace:   v.Namespace,
+			name:        v.Name,
+			annotations: v.Annotations,
+			selector:    v.Spec.Selector,
+			template:    v.Spec.Template,
+		})
+	}
+	return res, nil
+}
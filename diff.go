@@ -0,0 +1,210 @@
+package harbor_api
+
+import (
+	"bytes"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DiffKind is the kind of a difference between the source and the destination harbor
+type DiffKind string
+
+const (
+	// DiffMissingRepository means the repository of the source was not existed in the destination
+	DiffMissingRepository DiffKind = "MissingRepository"
+	// DiffMissingTag means the tag of the source was not existed in the destination
+	DiffMissingTag DiffKind = "MissingTag"
+	// DiffDigestMismatch means the tag pointed to different digests in the source and the destination
+	DiffDigestMismatch DiffKind = "DigestMismatch"
+)
+
+// DiffOptions controls which parts of the source harbor were compared by Diff
+type DiffOptions struct {
+	// Projects limits the diff to these projects, all the projects of the source were compared by default
+	Projects []string `json:"projects,omitempty"`
+}
+
+// DiffItem is one difference found by Diff, the tag and the digests were empty for a missing repository
+type DiffItem struct {
+	Kind              DiffKind `json:"kind"`
+	Project           string   `json:"project"`
+	Repository        string   `json:"repository"`
+	Tag               string   `json:"tag,omitempty"`
+	SourceDigest      string   `json:"sourceDigest,omitempty"`
+	DestinationDigest string   `json:"destinationDigest,omitempty"`
+}
+
+// DiffError is a project or a repository which couldn't be compared, the repository was empty for a project
+type DiffError struct {
+	Project    string `json:"project"`
+	Repository string `json:"repository,omitempty"`
+	Error      string `json:"error"`
+}
+
+// DiffReport is the result of Diff, the items and the errors were sorted by the project, the repository and the tag
+type DiffReport struct {
+	Source       string      `json:"source"`
+	Destination  string      `json:"destination"`
+	Time         time.Time   `json:"time"`
+	Projects     int         `json:"projects"`
+	Repositories int         `json:"repositories"`
+	Tags         int         `json:"tags"`
+	Items        []DiffItem  `json:"items"`
+	Errors       []DiffError `json:"errors,omitempty"`
+}
+
+// Consistent returns true if neither a difference nor an error was found
+func (r *DiffReport) Consistent() bool {
+	return len(r.Items) == 0 && len(r.Errors) == 0
+}
+
+// JSON encodes the report for the scheduled checks and the alerting
+func (r *DiffReport) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// String returns the human-readable report, one difference or error per line
+func (r *DiffReport) String() string {
+	b := &bytes.Buffer{}
+	_, _ = fmt.Fprintf(b, "diff %s -> %s at %s: %d projects, %d repositories, %d tags compared, %d differences, %d errors\n",
+		r.Source, r.Destination, r.Time.Format(time.RFC3339), r.Projects, r.Repositories, r.Tags, len(r.Items), len(r.Errors))
+	for _, v := range r.Items {
+		name := fmt.Sprintf("%s/%s", v.Project, v.Repository)
+		switch v.Kind {
+		case DiffMissingRepository:
+			_, _ = fmt.Fprintf(b, "missing repository  %s\n", name)
+		case DiffMissingTag:
+			_, _ = fmt.Fprintf(b, "missing tag         %s:%s %s\n", name, v.Tag, v.SourceDigest)
+		case DiffDigestMismatch:
+			_, _ = fmt.Fprintf(b, "digest mismatch     %s:%s %s != %s\n", name, v.Tag, v.SourceDigest, v.DestinationDigest)
+		}
+	}
+	for _, v := range r.Errors {
+		name := v.Project
+		if v.Repository != "" {
+			name = fmt.Sprintf("%s/%s", v.Project, v.Repository)
+		}
+		_, _ = fmt.Fprintf(b, "error               %s: %s\n", name, v.Error)
+	}
+	return b.String()
+}
+
+// Diff walks all the pages of the projects, the repositories and the tags of the source harbor, and compares them with the destination.
+// The repositories and the tags only existed in the destination were ignored, as they were not replicated from the source.
+// A project or a repository which failed to be listed was reported in Errors instead of failing the whole diff.
+func (h *hub) Diff(srcURL, dstURL string, opts DiffOptions) (*DiffReport, error) {
+	src, err := h.Get(srcURL)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := h.Get(dstURL)
+	if err != nil {
+		return nil, err
+	}
+	projects := opts.Projects
+	if len(projects) == 0 {
+		list, err := src.Projects()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			projects = append(projects, v.Name)
+		}
+	}
+	r := &DiffReport{
+		Source:      NormalizeUrl(srcURL),
+		Destination: NormalizeUrl(dstURL),
+		Time:        time.Now(),
+		Items:       make([]DiffItem, 0),
+		Errors:      make([]DiffError, 0),
+	}
+	for _, project := range projects {
+		r.Projects++
+		srcRepositories, err := src.Repositories(project)
+		if err != nil {
+			r.Errors = append(r.Errors, DiffError{Project: project, Error: err.Error()})
+			continue
+		}
+		dstRepositories, err := dst.Repositories(project)
+		// the project was not replicated yet, so that all of its repositories were missing
+		if err != nil && !IsNotFound(err) {
+			r.Errors = append(r.Errors, DiffError{Project: project, Error: err.Error()})
+			continue
+		}
+		existed := make(map[string]bool, len(dstRepositories))
+		for _, v := range dstRepositories {
+			existed[v.Name] = true
+		}
+		for _, v := range srcRepositories {
+			r.Repositories++
+			repository := strings.TrimPrefix(v.Name, project+"/")
+			if !existed[v.Name] {
+				r.Items = append(r.Items, DiffItem{Kind: DiffMissingRepository, Project: project, Repository: repository})
+				continue
+			}
+			r.diffTags(src, dst, project, repository)
+		}
+	}
+	sort.SliceStable(r.Items, func(i, j int) bool {
+		a, b := r.Items[i], r.Items[j]
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.Tag < b.Tag
+	})
+	sort.SliceStable(r.Errors, func(i, j int) bool {
+		a, b := r.Errors[i], r.Errors[j]
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		return a.Repository < b.Repository
+	})
+	return r, nil
+}
+
+// diffTags compares the tags of the repository, the untagged artifacts were ignored
+func (r *DiffReport) diffTags(src, dst HarborInterface, project, repository string) {
+	tags := func(t HarborInterface) (map[string]string, error) {
+		list, err := t.Artifacts(project, repository)
+		if err != nil {
+			return nil, err
+		}
+		res := make(map[string]string, len(list))
+		for _, a := range list {
+			for _, v := range a.Tags {
+				res[v.Name] = a.Digest
+			}
+		}
+		return res, nil
+	}
+	srcTags, err := tags(src)
+	if err != nil {
+		r.Errors = append(r.Errors, DiffError{Project: project, Repository: repository, Error: err.Error()})
+		return
+	}
+	dstTags, err := tags(dst)
+	if err != nil {
+		r.Errors = append(r.Errors, DiffError{Project: project, Repository: repository, Error: err.Error()})
+		return
+	}
+	for tag, digest := range srcTags {
+		r.Tags++
+		item := DiffItem{Project: project, Repository: repository, Tag: tag, SourceDigest: digest}
+		switch d, ok := dstTags[tag]; {
+		case !ok:
+			item.Kind = DiffMissingTag
+		case d != digest:
+			item.Kind = DiffDigestMismatch
+			item.DestinationDigest = d
+		default:
+			continue
+		}
+		r.Items = append(r.Items, item)
+	}
+}
@@ -0,0 +1,183 @@
+package harbor_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newDiffServer serves the projects, the repositories and the tags of repos, which were keyed by project/repository.
+// The listings were sorted and paginated like harbor.
+func newDiffServer(repos map[string]map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v2.0/projects")
+		projects := make(map[string][]string)
+		for k := range repos {
+			p := strings.SplitN(k, "/", 2)[0]
+			projects[p] = append(projects[p], k)
+		}
+		switch parts := strings.Split(strings.Trim(path, "/"), "/"); {
+		case path == "":
+			list := make([]string, 0)
+			for p := range projects {
+				list = append(list, fmt.Sprintf(`{"name":%q}`, p))
+			}
+			sort.Strings(list)
+			writePage(w, r, list)
+		case len(parts) == 2 && parts[1] == "repositories":
+			if parts[0] == "broken" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if _, ok := projects[parts[0]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			list := make([]string, 0)
+			for _, k := range projects[parts[0]] {
+				list = append(list, fmt.Sprintf(`{"name":%q}`, k))
+			}
+			sort.Strings(list)
+			writePage(w, r, list)
+		case len(parts) == 4 && parts[3] == "artifacts":
+			repository := strings.ReplaceAll(parts[2], "%252F", "/")
+			list := make([]string, 0)
+			for tag, digest := range repos[parts[0]+"/"+repository] {
+				list = append(list, fmt.Sprintf(`{"digest":%q,"tags":[{"name":%q}]}`, digest, tag))
+			}
+			sort.Strings(list)
+			writePage(w, r, list)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func Test_hub_Diff(t *testing.T) {
+	src := newDiffServer(map[string]map[string]string{
+		"proj/app":      {"latest": mirrorDigestA, "1.0": mirrorDigestA, "1.1": mirrorDigestB},
+		"proj/team/web": {"latest": mirrorDigestB},
+		"proj/missing":  {"latest": mirrorDigestA},
+		"other/base":    {"latest": mirrorDigestA},
+	})
+	defer src.Close()
+	dst := newDiffServer(map[string]map[string]string{
+		"proj/app":      {"latest": mirrorDigestB, "1.0": mirrorDigestA, "extra": mirrorDigestA},
+		"proj/team/web": {"latest": mirrorDigestB},
+		"proj/extra":    {"latest": mirrorDigestA},
+	})
+	defer dst.Close()
+	h := NewHub([]Config{{Url: src.URL}, {Url: dst.URL}})
+	defer h.Close()
+
+	tests := []struct {
+		name       string
+		opts       DiffOptions
+		want       []DiffItem
+		wantErrors []DiffError
+		wantTags   int
+	}{
+		{
+			name: "Test_hub_Diff_all",
+			want: []DiffItem{
+				{Kind: DiffMissingRepository, Project: "other", Repository: "base"},
+				{Kind: DiffMissingTag, Project: "proj", Repository: "app", Tag: "1.1", SourceDigest: mirrorDigestB},
+				{Kind: DiffDigestMismatch, Project: "proj", Repository: "app", Tag: "latest", SourceDigest: mirrorDigestA, DestinationDigest: mirrorDigestB},
+				{Kind: DiffMissingRepository, Project: "proj", Repository: "missing"},
+			},
+			wantErrors: []DiffError{},
+			wantTags:   4,
+		},
+		{
+			name:       "Test_hub_Diff_projects",
+			opts:       DiffOptions{Projects: []string{"other", "broken"}},
+			want:       []DiffItem{{Kind: DiffMissingRepository, Project: "other", Repository: "base"}},
+			wantErrors: []DiffError{{Project: "broken", Error: (&StatusError{Code: http.StatusInternalServerError}).Error()}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.Diff(src.URL, dst.URL, tt.opts)
+			if err != nil {
+				t.Fatalf("hub.Diff() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Items, tt.want) {
+				t.Errorf("hub.Diff() items = %+v, want %+v", got.Items, tt.want)
+			}
+			if !reflect.DeepEqual(got.Errors, tt.wantErrors) {
+				t.Errorf("hub.Diff() errors = %+v, want %+v", got.Errors, tt.wantErrors)
+			}
+			if got.Tags != tt.wantTags || got.Consistent() {
+				t.Errorf("hub.Diff() tags = %v consistent = %v, want %v tags and inconsistent", got.Tags, got.Consistent(), tt.wantTags)
+			}
+			b, err := got.JSON()
+			if err != nil {
+				t.Fatalf("DiffReport.JSON() error = %v", err)
+			}
+			decoded := &DiffReport{}
+			if err = json.Unmarshal(b, decoded); err != nil || !reflect.DeepEqual(decoded.Items, got.Items) {
+				t.Errorf("DiffReport.JSON() = %s, %v", b, err)
+			}
+			if lines := strings.Split(strings.TrimSpace(got.String()), "\n"); len(lines) != 1+len(tt.want)+len(tt.wantErrors) {
+				t.Errorf("DiffReport.String() = %s", got.String())
+			}
+		})
+	}
+
+	got, err := h.Diff(src.URL, src.URL, DiffOptions{})
+	if err != nil || !got.Consistent() {
+		t.Errorf("hub.Diff() of the same harbor = %+v, %v, want consistent", got, err)
+	}
+	if !strings.Contains(got.String(), "4 repositories, 6 tags compared, 0 differences") {
+		t.Errorf("DiffReport.String() = %s", got.String())
+	}
+	if _, err = h.Diff(src.URL, "harbor.domain13333.com", DiffOptions{}); err == nil {
+		t.Errorf("hub.Diff() succeeded with an unknown harbor")
+	}
+}
+
+func Test_hub_Diff_Pages(t *testing.T) {
+	// 60 tags and 60 repositories span two pages of the artifacts and the repositories of harbor
+	srcRepos := map[string]map[string]string{"proj/app": {}}
+	dstRepos := map[string]map[string]string{"proj/app": {}}
+	for n := 0; n < 60; n++ {
+		tag := fmt.Sprintf("tag-%02d", n)
+		srcRepos["proj/app"][tag] = mirrorDigestA
+		if n != 58 {
+			dstRepos["proj/app"][tag] = mirrorDigestA
+		}
+		repository := fmt.Sprintf("proj/repo-%02d", n)
+		srcRepos[repository] = map[string]string{"latest": mirrorDigestA}
+		if n != 59 {
+			dstRepos[repository] = map[string]string{"latest": mirrorDigestA}
+		}
+	}
+	dstRepos["proj/app"]["tag-57"] = mirrorDigestB
+	src := newDiffServer(srcRepos)
+	defer src.Close()
+	dst := newDiffServer(dstRepos)
+	defer dst.Close()
+	h := NewHub([]Config{{Url: src.URL}, {Url: dst.URL}})
+	defer h.Close()
+
+	got, err := h.Diff(src.URL, dst.URL, DiffOptions{})
+	if err != nil {
+		t.Fatalf("hub.Diff() error = %v", err)
+	}
+	want := []DiffItem{
+		{Kind: DiffDigestMismatch, Project: "proj", Repository: "app", Tag: "tag-57", SourceDigest: mirrorDigestA, DestinationDigest: mirrorDigestB},
+		{Kind: DiffMissingTag, Project: "proj", Repository: "app", Tag: "tag-58", SourceDigest: mirrorDigestA},
+		{Kind: DiffMissingRepository, Project: "proj", Repository: "repo-59"},
+	}
+	if !reflect.DeepEqual(got.Items, want) {
+		t.Errorf("hub.Diff() items = %+v, want %+v", got.Items, want)
+	}
+	if got.Repositories != 61 || got.Tags != 119 || len(got.Errors) != 0 {
+		t.Errorf("hub.Diff() = %v repositories %v tags errors %+v, want 61 and 119", got.Repositories, got.Tags, got.Errors)
+	}
+}
@@ -4,6 +4,10 @@ go 1.15
 
 require (
 	github.com/Shanghai-Lunara/pkg v0.0.0-20210410040202-9b354dbed557
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/goharbor/harbor/src v0.0.0-20210128101059-eb5e31a44281
+	k8s.io/api v0.20.4
 	k8s.io/apimachinery v0.20.4
+	k8s.io/client-go v0.20.4
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -2,6 +2,7 @@ package harbor_api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Shanghai-Lunara/pkg/zaplogger"
 	"github.com/goharbor/harbor/src/common/models"
@@ -12,7 +13,9 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,32 +26,89 @@ type HarborGetter interface {
 type HarborInterface interface {
 	Http(method string, url string) (res *http.Response, err error)
 	Login() error
+	// Projects, Repositories and Artifacts follow the Link headers of harbor through all the pages
 	Projects() (res []models.Project, err error)
 	Repositories(projectName string) (res []models.RepoRecord, err error)
 	Artifacts(projectName string, repositoryName string) (res []artifact.Artifact, err error)
 	Tags(projectName string, repositoryName string) (res []*tag.Tag, err error)
 	References(projectName string, repositoryName string, digestOrTag string) (res artifact.Artifact, err error)
+	// Platforms returns the platform manifests of the image index, or the artifact itself if it was not an index
+	Platforms(projectName string, repositoryName string, digestOrTag string) (res []PlatformManifest, err error)
+	// Search searches the projects and the repositories by name, it merges the repository listing into the results.
+	// Once the repository listing failed, the results of the search api were returned with a *PartialSearchError.
+	Search(ctx context.Context, query string) (res SearchResult, err error)
+	Health() (res OverallHealthStatus, err error)
+	SystemInfo() (res GeneralInfo, err error)
+	// SetCredentials replaces the admin and the password in place, the active watches keep running
+	SetCredentials(admin, password string)
+	// Registry returns the registry v2 client of the harbor sharing the same credentials
+	Registry() RegistryInterface
 	Watch(opt Option) (watch.Interface, error)
+	ListWatches() []WatchStatus
+	// Follow attaches to the active watch of the image name without keeping it alive, see Images.Follow
+	Follow(name string) (watch.Interface, error)
+	Unwatch(name string) error
+	Stats() ImagesStats
+	Close(ctx context.Context) error
 }
 
-func NewHarbor(url, admin, password string) HarborInterface {
+type HarborOptions struct {
+	// RegistryPolling polls the watched tags by the manifest HEAD of the registry with If-None-Match,
+	// instead of the artifact api which expands the tags from the database of harbor. The artifact api
+	// was still called once the registry failed.
+	RegistryPolling bool
+}
+
+type HarborOption func(*HarborOptions)
+
+// WithRegistryPolling polls the watched tags by the manifest HEAD of the registry, see HarborOptions
+func WithRegistryPolling() HarborOption {
+	return func(o *HarborOptions) {
+		o.RegistryPolling = true
+	}
+}
+
+func NewHarbor(url, admin, password string, opts ...HarborOption) HarborInterface {
+	return newHarbor(url, admin, password, nil, nil, opts...)
+}
+
+// newHarbor polls the watches by the handlers, which default to the References and the Artifacts of the harbor itself
+func newHarbor(url, admin, password string, handler RequestHandler, list ListHandler, opts ...HarborOption) *harbor {
+	o := &HarborOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	h := &harbor{
-		url:      url,
+		url:      strings.TrimRight(url, "/"),
 		admin:    admin,
 		password: password,
 		timeout:  10,
 	}
-	h.images = NewImages(context.Background(), h.References)
+	if handler == nil {
+		handler = h.References
+	}
+	if list == nil {
+		list = h.artifactsPage
+	}
+	h.registry = newRegistry(h.url, h.credentials)
+	c := ImagesConfig{ListHandler: list}
+	if o.RegistryPolling {
+		c.DigestHandler = h.manifestDigest
+	}
+	h.images = NewImagesWithConfig(context.Background(), handler, c)
 	return h
 }
 
 type harbor struct {
-	url      string
+	url string
+	// mu guards admin and password, which were replaced by SetCredentials
+	mu       sync.RWMutex
 	admin    string
 	password string
 	timeout  int
 
-	images Images
+	images   Images
+	registry *registry
 }
 
 type HarborUrlSuffix string
@@ -60,16 +120,63 @@ const (
 	Artifacts    HarborUrlSuffix = "api/v2.0/projects/%s/repositories/%s/artifacts?with_tag=true&with_scan_overview=false&with_label=false&with_immutable_status=false&page_size=50&page=1"
 	References   HarborUrlSuffix = "api/v2.0/projects/%s/repositories/%s/artifacts/%s?with_tag=true&with_scan_overview=false&with_label=false&with_immutable_status=false"
 	TagOne       HarborUrlSuffix = "api/repositories/%s/tags/%s" // api/repositories/helix-saga/go-all/tags/latest
+	Search       HarborUrlSuffix = "api/v2.0/search?q=%s"
+	// ListRepositories lists the repositories of all the projects, whose names fuzzy match the query
+	ListRepositories HarborUrlSuffix = "api/v2.0/repositories?q=name%%3D~%s&page=1&page_size=100"
+	Health           HarborUrlSuffix = "api/v2.0/health"
+	SystemInfo       HarborUrlSuffix = "api/v2.0/systeminfo"
+)
+
+const (
+	ErrorUnexpectedStatusCode = "error: harbor responded with status code:%d body:%s"
 )
 
+var (
+	// linkNextRegexp matches the next page inside a Link header, such as <...&page=2>; rel="next"
+	linkNextRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+)
+
+// StatusError was returned when harbor responds with a non-200 status code
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf(ErrorUnexpectedStatusCode, e.Code, e.Body)
+}
+
+// NewStatusError drains and closes the response body, then wraps the status code
+func NewStatusError(resp *http.Response) error {
+	cont, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		zaplogger.Sugar().Error(err)
+	}
+	if err = resp.Body.Close(); err != nil {
+		zaplogger.Sugar().Error(err)
+	}
+	return &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(cont))}
+}
+
+// IsNotFound returns true if the error was caused by a 404 response from harbor
+func IsNotFound(err error) bool {
+	var e *StatusError
+	return errors.As(err, &e) && e.Code == http.StatusNotFound
+}
+
 func (h *harbor) Http(method string, url string) (res *http.Response, err error) {
+	return h.httpWithContext(context.Background(), method, url)
+}
+
+// httpWithContext was the same as Http, and the request was canceled once ctx was done
+func (h *harbor) httpWithContext(ctx context.Context, method string, url string) (res *http.Response, err error) {
 	zaplogger.Sugar().Debugw("harbor-api http", "method", method, "url", url)
 	var req *http.Request
-	if req, err = http.NewRequest(method, url, nil); err != nil {
+	if req, err = http.NewRequestWithContext(ctx, method, url, nil); err != nil {
 		zaplogger.Sugar().Error(err)
 		return res, err
 	}
-	req.SetBasicAuth(h.admin, h.password)
+	req.SetBasicAuth(h.credentials())
 	httpClient := http.Client{
 		Timeout: time.Second * time.Duration(h.timeout),
 	}
@@ -79,6 +186,31 @@ func (h *harbor) Http(method string, url string) (res *http.Response, err error)
 	return res, err
 }
 
+func (h *harbor) credentials() (admin, password string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.admin, h.password
+}
+
+func (h *harbor) SetCredentials(admin, password string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.admin, h.password = admin, password
+}
+
+func (h *harbor) Registry() RegistryInterface {
+	return h.registry
+}
+
+// manifestDigest was the DigestHandler of the watches, it sends a manifest HEAD to the registry
+func (h *harbor) manifestDigest(projectName string, repositoryName string, tag string, etag string) (string, string, error) {
+	res, err := h.registry.CheckManifest(context.Background(), fmt.Sprintf("%s/%s", projectName, repositoryName), tag, etag)
+	if err != nil {
+		return "", "", err
+	}
+	return res.Descriptor.Digest, res.ETag, nil
+}
+
 func (h *harbor) Login() error {
 	var (
 		req  *http.Request
@@ -87,9 +219,10 @@ func (h *harbor) Login() error {
 	)
 	u := fmt.Sprintf("%s/%v", h.url, Login)
 	zaplogger.Sugar().Info("url:", u)
+	admin, password := h.credentials()
 	data := url.Values{}
-	data.Set("principal", h.admin)
-	data.Set("password", h.password)
+	data.Set("principal", admin)
+	data.Set("password", password)
 	body := ioutil.NopCloser(strings.NewReader(data.Encode())) // endode v:[body struce]
 	req, err = http.NewRequest("POST", u, body)
 	if err != nil {
@@ -97,7 +230,7 @@ func (h *harbor) Login() error {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;param=value") // setting post head
-	req.SetBasicAuth(h.admin, h.password)
+	req.SetBasicAuth(admin, password)
 	httpClient := http.Client{
 		Timeout: time.Second * time.Duration(h.timeout),
 	}
@@ -108,85 +241,137 @@ func (h *harbor) Login() error {
 		return err
 	}
 	zaplogger.Sugar().Info(resp)
-	_ = resp
-	return err
+	if resp.StatusCode != http.StatusOK {
+		return NewStatusError(resp)
+	}
+	return resp.Body.Close()
 }
 
-func (h *harbor) Projects() (res []models.Project, err error) {
-	var resp *http.Response
-	if resp, err = h.Http("GET", fmt.Sprintf("%s/%v", h.url, Projects)); err != nil {
-		return res, err
-	}
-	if resp.StatusCode == http.StatusOK {
-		cont, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
-		}
-		if err = resp.Body.Close(); err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
-		}
-		if err = json.Unmarshal(cont, &res); err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
-		}
+// EscapeRepositoryName escapes the repository name for the repository-scoped paths,
+// harbor requires the names with slashes such as team/app to be double encoded like team%252Fapp
+func EscapeRepositoryName(repositoryName string) string {
+	return url.PathEscape(url.PathEscape(repositoryName))
+}
+
+// RepositorySuffix formats a repository-scoped url suffix such as Artifacts or References,
+// the project name and the optional digest or tag were escaped once, and the repository name twice
+func RepositorySuffix(suffix HarborUrlSuffix, projectName string, repositoryName string, digestOrTag ...string) string {
+	args := []interface{}{url.PathEscape(projectName), EscapeRepositoryName(repositoryName)}
+	for _, v := range digestOrTag {
+		args = append(args, url.PathEscape(v))
 	}
-	return res, nil
+	return fmt.Sprintf(string(suffix), args...)
 }
 
-func (h *harbor) Repositories(projectName string) (res []models.RepoRecord, err error) {
-	var (
-		suffix string
-		resp   *http.Response
-	)
-	suffix = fmt.Sprintf(string(Repositories), projectName)
-	if resp, err = h.Http("GET", fmt.Sprintf("%s/%v", h.url, suffix)); err != nil {
-		return res, err
+// get requests the url suffix and decodes the json body into res, a non-200 response returns a StatusError
+func (h *harbor) get(suffix string, res interface{}) error {
+	return h.getWithContext(context.Background(), suffix, res)
+}
+
+func (h *harbor) getWithContext(ctx context.Context, suffix string, res interface{}) error {
+	resp, err := h.httpWithContext(ctx, "GET", fmt.Sprintf("%s/%v", h.url, suffix))
+	if err != nil {
+		return err
 	}
-	if resp.StatusCode == http.StatusOK {
+	if resp.StatusCode != http.StatusOK {
+		return NewStatusError(resp)
+	}
+	cont, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		zaplogger.Sugar().Error(err)
+		return err
+	}
+	if err = resp.Body.Close(); err != nil {
+		zaplogger.Sugar().Error(err)
+		return err
+	}
+	if err = json.Unmarshal(cont, res); err != nil {
+		zaplogger.Sugar().Error(err)
+		return err
+	}
+	return nil
+}
+
+// getPages requests the paginated url suffix and follows the Link headers of harbor to the next pages,
+// each page was passed to decode, a non-200 response returns a StatusError
+func (h *harbor) getPages(suffix string, decode func(cont []byte) error) error {
+	u := fmt.Sprintf("%s/%v", h.url, suffix)
+	for u != "" {
+		resp, err := h.httpWithContext(context.Background(), "GET", u)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return NewStatusError(resp)
+		}
 		cont, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
 		if err != nil {
 			zaplogger.Sugar().Error(err)
-			return res, err
+			return err
 		}
-		if err = resp.Body.Close(); err != nil {
+		if err = decode(cont); err != nil {
 			zaplogger.Sugar().Error(err)
-			return res, err
+			return err
 		}
-		if err = json.Unmarshal(cont, &res); err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
+		m := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link"))
+		if m == nil {
+			return nil
+		}
+		next, err := resp.Request.URL.Parse(m[1])
+		if err != nil {
+			return err
 		}
+		// a Link pointing back to the same page would never end
+		if next.String() == u {
+			return nil
+		}
+		u = next.String()
 	}
-	return res, nil
+	return nil
 }
 
-func (h *harbor) Artifacts(projectName string, repositoryName string) (res []artifact.Artifact, err error) {
-	var (
-		suffix string
-		resp   *http.Response
-	)
-	suffix = fmt.Sprintf(string(Artifacts), projectName, repositoryName)
-	if resp, err = h.Http("GET", fmt.Sprintf("%s/%v", h.url, suffix)); err != nil {
-		return res, err
-	}
-	if resp.StatusCode == http.StatusOK {
-		cont, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
+func (h *harbor) Projects() (res []models.Project, err error) {
+	err = h.getPages(string(Projects), func(cont []byte) error {
+		page := make([]models.Project, 0)
+		if err := json.Unmarshal(cont, &page); err != nil {
+			return err
 		}
-		if err = resp.Body.Close(); err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
+		res = append(res, page...)
+		return nil
+	})
+	return res, err
+}
+
+func (h *harbor) Repositories(projectName string) (res []models.RepoRecord, err error) {
+	err = h.getPages(fmt.Sprintf(string(Repositories), url.PathEscape(projectName)), func(cont []byte) error {
+		page := make([]models.RepoRecord, 0)
+		if err := json.Unmarshal(cont, &page); err != nil {
+			return err
 		}
-		if err = json.Unmarshal(cont, &res); err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
+		res = append(res, page...)
+		return nil
+	})
+	return res, err
+}
+
+func (h *harbor) Artifacts(projectName string, repositoryName string) (res []artifact.Artifact, err error) {
+	err = h.getPages(RepositorySuffix(Artifacts, projectName, repositoryName), func(cont []byte) error {
+		page := make([]artifact.Artifact, 0)
+		if err := json.Unmarshal(cont, &page); err != nil {
+			return err
 		}
-	}
-	return res, nil
+		res = append(res, page...)
+		return nil
+	})
+	return res, err
+}
+
+// artifactsPage lists the first page of the artifacts, it was the ListHandler of the batch polling,
+// whose images missing from the page fall back to the RequestHandler
+func (h *harbor) artifactsPage(projectName string, repositoryName string) (res []artifact.Artifact, err error) {
+	err = h.get(RepositorySuffix(Artifacts, projectName, repositoryName), &res)
+	return res, err
 }
 
 func (h *harbor) Tags(projectName string, repositoryName string) (res []*tag.Tag, err error) {
@@ -202,37 +387,84 @@ func (h *harbor) Tags(projectName string, repositoryName string) (res []*tag.Tag
 }
 
 func (h *harbor) References(projectName string, repositoryName string, digestOrTag string) (res artifact.Artifact, err error) {
-	var (
-		suffix string
-		resp   *http.Response
-	)
-	suffix = fmt.Sprintf(string(References), projectName, repositoryName, digestOrTag)
-	if resp, err = h.Http("GET", fmt.Sprintf("%s/%v", h.url, suffix)); err != nil {
+	err = h.get(RepositorySuffix(References, projectName, repositoryName, digestOrTag), &res)
+	return res, err
+}
+
+func (h *harbor) Platforms(projectName string, repositoryName string, digestOrTag string) (res []PlatformManifest, err error) {
+	a, err := h.References(projectName, repositoryName, digestOrTag)
+	if err != nil {
+		return nil, err
+	}
+	return ArtifactPlatforms(a), nil
+}
+
+func (h *harbor) Search(ctx context.Context, query string) (res SearchResult, err error) {
+	if err = h.getWithContext(ctx, fmt.Sprintf(string(Search), url.QueryEscape(query)), &res); err != nil {
 		return res, err
 	}
-	if resp.StatusCode == http.StatusOK {
-		cont, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
-		}
-		if err = resp.Body.Close(); err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
-		}
-		if err = json.Unmarshal(cont, &res); err != nil {
-			zaplogger.Sugar().Error(err)
-			return res, err
+	// the search api was limited to the first results of the projects, the repository listing fills the rest
+	repositories := make([]models.RepoRecord, 0)
+	if err = h.getWithContext(ctx, fmt.Sprintf(string(ListRepositories), url.QueryEscape(query)), &repositories); err != nil {
+		zaplogger.Sugar().Errorw("harbor repository listing failed", "url", h.url, "query", query, "err", err)
+		return res, &PartialSearchError{Err: err}
+	}
+	found := make(map[string]bool, len(res.Repository))
+	for _, v := range res.Repository {
+		found[v.RepositoryName] = true
+	}
+	for _, v := range repositories {
+		if found[v.Name] {
+			continue
 		}
+		res.Repository = append(res.Repository, SearchRepository{
+			ProjectID:      v.ProjectID,
+			ProjectName:    strings.SplitN(v.Name, "/", 2)[0],
+			RepositoryName: v.Name,
+			PullCount:      v.PullCount,
+		})
 	}
 	return res, nil
 }
 
+func (h *harbor) Health() (res OverallHealthStatus, err error) {
+	err = h.get(string(Health), &res)
+	return res, err
+}
+
+func (h *harbor) SystemInfo() (res GeneralInfo, err error) {
+	err = h.get(string(SystemInfo), &res)
+	return res, err
+}
+
 func (h *harbor) Watch(opt Option) (watch.Interface, error) {
 	image, err := h.images.Image(opt)
 	if err != nil {
 		zaplogger.Sugar().Error(err)
 		return nil, err
 	}
-	return image.Watch(), nil
+	if opt.SendInitialEvents {
+		return image.WatchFromWithInitialEvents(opt.Sha256), nil
+	}
+	return image.WatchFrom(opt.Sha256), nil
+}
+
+func (h *harbor) ListWatches() []WatchStatus {
+	return h.images.ListWatches()
+}
+
+func (h *harbor) Follow(name string) (watch.Interface, error) {
+	return h.images.Follow(name)
+}
+
+func (h *harbor) Unwatch(name string) error {
+	return h.images.Unwatch(name)
+}
+
+func (h *harbor) Stats() ImagesStats {
+	return h.images.Stats()
+}
+
+func (h *harbor) Close(ctx context.Context) error {
+	return h.images.Close(ctx)
 }
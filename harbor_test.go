@@ -1,6 +1,7 @@
 package harbor_api
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Shanghai-Lunara/pkg/zaplogger"
 	"github.com/goharbor/harbor/src/common/models"
@@ -8,7 +9,9 @@ import (
 	"github.com/goharbor/harbor/src/controller/tag"
 	"k8s.io/apimachinery/pkg/watch"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -527,3 +530,199 @@ func Test_harbor_References(t *testing.T) {
 	}
 	zaplogger.Sugar().Infof("Test_harbor_References End \n\n\n")
 }
+
+func TestRepositorySuffix(t *testing.T) {
+	type args struct {
+		suffix         HarborUrlSuffix
+		projectName    string
+		repositoryName string
+		digestOrTag    []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "RepositorySuffix_plain",
+			args: args{suffix: Artifacts, projectName: "helix-saga", repositoryName: "go-all"},
+			want: "api/v2.0/projects/helix-saga/repositories/go-all/artifacts",
+		},
+		{
+			name: "RepositorySuffix_nested",
+			args: args{suffix: Artifacts, projectName: "proj", repositoryName: "team/sub/app"},
+			want: "api/v2.0/projects/proj/repositories/team%252Fsub%252Fapp/artifacts",
+		},
+		{
+			name: "RepositorySuffix_special_characters",
+			args: args{suffix: References, projectName: "proj", repositoryName: "team/app v1?#", digestOrTag: []string{"1.2"}},
+			want: "api/v2.0/projects/proj/repositories/team%252Fapp%2520v1%253F%2523/artifacts/1.2",
+		},
+		{
+			name: "RepositorySuffix_digest",
+			args: args{suffix: References, projectName: "proj", repositoryName: "team/app", digestOrTag: []string{"sha256:27d6aa8f"}},
+			want: "api/v2.0/projects/proj/repositories/team%252Fapp/artifacts/sha256:27d6aa8f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RepositorySuffix(tt.args.suffix, tt.args.projectName, tt.args.repositoryName, tt.args.digestOrTag...)
+			if got = strings.SplitN(got, "?", 2)[0]; got != tt.want {
+				t.Errorf("RepositorySuffix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_harbor_EscapedPaths(t *testing.T) {
+	paths := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.EscapedPath()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/missing"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[{"code":"NOT_FOUND"}]}`))
+		case strings.HasSuffix(r.URL.Path, "/artifacts"):
+			_, _ = w.Write([]byte(`[]`))
+		default:
+			_, _ = w.Write([]byte(`{"digest":"sha256:27d6aa8f"}`))
+		}
+	}))
+	defer s.Close()
+	h := &harbor{url: s.URL, admin: fc.admin, password: fc.password, timeout: fc.timeout}
+
+	if _, err := h.Artifacts("proj", "team/app"); err != nil {
+		t.Fatalf("harbor.Artifacts() error = %v", err)
+	}
+	if got, want := <-paths, "/api/v2.0/projects/proj/repositories/team%252Fapp/artifacts"; got != want {
+		t.Errorf("harbor.Artifacts() path = %v, want %v", got, want)
+	}
+	res, err := h.References("proj", "team/sub/app", "latest")
+	if err != nil || res.Digest != "sha256:27d6aa8f" {
+		t.Fatalf("harbor.References() = %v, error = %v", res.Digest, err)
+	}
+	if got, want := <-paths, "/api/v2.0/projects/proj/repositories/team%252Fsub%252Fapp/artifacts/latest"; got != want {
+		t.Errorf("harbor.References() path = %v, want %v", got, want)
+	}
+	_, err = h.References("proj", "team/app", "missing")
+	<-paths
+	if !IsNotFound(err) {
+		t.Errorf("harbor.References() error = %v, want a 404 StatusError", err)
+	}
+}
+
+func Test_harbor_StatusError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer s.Close()
+	h := &harbor{url: s.URL, admin: fc.admin, password: fc.password, timeout: fc.timeout}
+	calls := map[string]func() error{
+		"Login": h.Login,
+		"Projects": func() error {
+			_, err := h.Projects()
+			return err
+		},
+		"Repositories": func() error {
+			_, err := h.Repositories("proj")
+			return err
+		},
+		"Artifacts": func() error {
+			_, err := h.Artifacts("proj", "team/app")
+			return err
+		},
+		"Tags": func() error {
+			_, err := h.Tags("proj", "team/app")
+			return err
+		},
+		"References": func() error {
+			_, err := h.References("proj", "team/app", "latest")
+			return err
+		},
+	}
+	for name, call := range calls {
+		var e *StatusError
+		if err := call(); !errors.As(err, &e) || e.Code != http.StatusUnauthorized {
+			t.Errorf("harbor.%s() error = %v, want a 401 StatusError", name, err)
+		}
+	}
+}
+
+// writePage writes the page of the json items selected by the page and page_size queries,
+// and links the previous and the next pages like harbor
+func writePage(w http.ResponseWriter, r *http.Request, items []string) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 {
+		size = 10
+	}
+	start, end := (page-1)*size, page*size
+	if start > len(items) {
+		start = len(items)
+	}
+	if end > len(items) {
+		end = len(items)
+	}
+	link := func(page int, rel string) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(page))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.EscapedPath(), q.Encode(), rel)
+	}
+	links := make([]string, 0)
+	if page > 1 {
+		links = append(links, link(page-1, "prev"))
+	}
+	if end < len(items) {
+		links = append(links, link(page+1, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, " , "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+	_, _ = fmt.Fprintf(w, "[%s]", strings.Join(items[start:end], ","))
+}
+
+func Test_harbor_Pages(t *testing.T) {
+	items := func(n int, format string) []string {
+		res := make([]string, 0, n)
+		for k := 0; k < n; k++ {
+			res = append(res, fmt.Sprintf(format, k))
+		}
+		return res
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v2.0/projects":
+			writePage(w, r, items(120, `{"name":"proj-%d"}`))
+		case "/api/v2.0/projects/proj/repositories":
+			writePage(w, r, items(51, `{"name":"proj/app-%d"}`))
+		case "/api/v2.0/projects/proj/repositories/team%252Fapp/artifacts":
+			writePage(w, r, items(120, `{"digest":"sha256:%d"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	h := &harbor{url: s.URL, admin: fc.admin, password: fc.password, timeout: fc.timeout}
+
+	projects, err := h.Projects()
+	if err != nil || len(projects) != 120 || projects[119].Name != "proj-119" {
+		t.Errorf("harbor.Projects() = %d projects, error = %v, want 120", len(projects), err)
+	}
+	repositories, err := h.Repositories("proj")
+	if err != nil || len(repositories) != 51 || repositories[50].Name != "proj/app-50" {
+		t.Errorf("harbor.Repositories() = %d repositories, error = %v, want 51", len(repositories), err)
+	}
+	artifacts, err := h.Artifacts("proj", "team/app")
+	if err != nil || len(artifacts) != 120 || artifacts[119].Digest != "sha256:119" {
+		t.Errorf("harbor.Artifacts() = %d artifacts, error = %v, want 120", len(artifacts), err)
+	}
+	// the batch polling only lists the first page
+	if artifacts, err = h.artifactsPage("proj", "team/app"); err != nil || len(artifacts) != 50 {
+		t.Errorf("harbor.artifactsPage() = %d artifacts, error = %v, want 50", len(artifacts), err)
+	}
+	if _, err = h.Repositories("missing"); !IsNotFound(err) {
+		t.Errorf("harbor.Repositories() error = %v, want not found", err)
+	}
+}
@@ -0,0 +1,171 @@
+package harbor_api
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorHarborWasUnreachable = "error: the harbor url:%s was unreachable, last error:%s"
+	ErrorUnhealthyComponents  = "error: unhealthy components:%s"
+
+	// HealthStatusHealthy was the status of a healthy harbor or component in the health api
+	HealthStatusHealthy = "healthy"
+)
+
+// ComponentHealthStatus is the status of one harbor component, such as core, registry or database
+type ComponentHealthStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// OverallHealthStatus is the response of /api/v2.0/health
+type OverallHealthStatus struct {
+	Status     string                  `json:"status"`
+	Components []ComponentHealthStatus `json:"components"`
+}
+
+// GeneralInfo is the part of the response of /api/v2.0/systeminfo
+type GeneralInfo struct {
+	HarborVersion       string `json:"harbor_version"`
+	RegistryUrl         string `json:"registry_url"`
+	ExternalUrl         string `json:"external_url"`
+	AuthMode            string `json:"auth_mode"`
+	SelfRegistration    bool   `json:"self_registration"`
+	HasCARoot           bool   `json:"has_ca_root"`
+	ReadOnly            bool   `json:"read_only"`
+	WithChartmuseum     bool   `json:"with_chartmuseum"`
+	NotificationEnable  bool   `json:"notification_enable"`
+	RegistryStorageType string `json:"registry_storage_provider_name"`
+}
+
+type HealthState string
+
+const (
+	// HealthStateUnknown was the state before the first check
+	HealthStateUnknown HealthState = "unknown"
+	// HealthStateHealthy means all the components were healthy
+	HealthStateHealthy HealthState = "healthy"
+	// HealthStateDegraded means harbor responded, but some components were unhealthy or the systeminfo failed
+	HealthStateDegraded HealthState = "degraded"
+	// HealthStateUnreachable means the health api failed
+	HealthStateUnreachable HealthState = "unreachable"
+)
+
+// HarborStatus is the result of the last health check of a harbor
+type HarborStatus struct {
+	Url       string        `json:"url"`
+	State     HealthState   `json:"state"`
+	Version   string        `json:"version,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	LastError string        `json:"lastError,omitempty"`
+	LastCheck time.Time     `json:"lastCheck,omitempty"`
+
+	Components []ComponentHealthStatus `json:"components,omitempty"`
+}
+
+type GetOptions struct {
+	// SkipUnhealthy makes Get fail for an unreachable harbor, the unchecked and the degraded ones were still returned
+	SkipUnhealthy bool
+}
+
+type GetOption func(*GetOptions)
+
+// SkipUnhealthy makes Get fail for the harbors whose last health check was unreachable
+func SkipUnhealthy() GetOption {
+	return func(o *GetOptions) {
+		o.SkipUnhealthy = true
+	}
+}
+
+// checkHealth requests the health and the systeminfo api of the harbor
+func checkHealth(url string, h HarborInterface) HarborStatus {
+	res := HarborStatus{
+		Url:       url,
+		LastCheck: time.Now(),
+	}
+	health, err := h.Health()
+	res.Latency = time.Since(res.LastCheck)
+	if err != nil {
+		res.State = HealthStateUnreachable
+		res.LastError = err.Error()
+		return res
+	}
+	res.State = HealthStateHealthy
+	res.Components = health.Components
+	if health.Status != HealthStatusHealthy {
+		unhealthy := make([]string, 0)
+		for _, v := range health.Components {
+			if v.Status != HealthStatusHealthy {
+				unhealthy = append(unhealthy, v.Name)
+			}
+		}
+		res.State = HealthStateDegraded
+		res.LastError = fmt.Sprintf(ErrorUnhealthyComponents, strings.Join(unhealthy, ","))
+	}
+	info, err := h.SystemInfo()
+	if err != nil {
+		res.State = HealthStateDegraded
+		res.LastError = err.Error()
+		return res
+	}
+	res.Version = info.HarborVersion
+	return res
+}
+
+// CheckHealth checks all the harbors concurrently, and records their status
+func (h *hub) CheckHealth() {
+	h.mu.RLock()
+	harbors := make(map[string]*hubHarbor, len(h.harbors))
+	for k, v := range h.harbors {
+		harbors[k] = v
+	}
+	h.mu.RUnlock()
+	var wg sync.WaitGroup
+	for k, v := range harbors {
+		wg.Add(1)
+		go func(key string, t *hubHarbor) {
+			defer wg.Done()
+			status := checkHealth(t.url, t.harbor)
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			// the harbor may have been removed or replaced during the check
+			if h.harbors[key] == t {
+				t.status = status
+			}
+		}(k, v)
+	}
+	wg.Wait()
+}
+
+// RunHealthChecks checks all the harbors every interval until ctx was done
+func (h *hub) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		h.CheckHealth()
+	}, interval)
+}
+
+// Status returns the last health check of all the harbors, sorted by their urls
+func (h *hub) Status() []HarborStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	res := make([]HarborStatus, 0, len(h.harbors))
+	for _, v := range h.harbors {
+		status := v.status
+		status.Url = v.url
+		if status.State == "" {
+			status.State = HealthStateUnknown
+		}
+		res = append(res, status)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Url < res[j].Url
+	})
+	return res
+}
@@ -0,0 +1,91 @@
+package harbor_api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newHealthServer(health string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + string(Health):
+			_, _ = w.Write([]byte(health))
+		case "/" + string(SystemInfo):
+			_, _ = w.Write([]byte(`{"harbor_version":"v2.2.0-6de2c8e6"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func Test_hub_Status(t *testing.T) {
+	healthy := newHealthServer(`{"status":"healthy","components":[{"name":"core","status":"healthy"},{"name":"registry","status":"healthy"}]}`)
+	defer healthy.Close()
+	degraded := newHealthServer(`{"status":"unhealthy","components":[{"name":"core","status":"healthy"},{"name":"trivy","status":"unhealthy","error":"timeout"}]}`)
+	defer degraded.Close()
+	unreachable := newHealthServer("")
+	unreachable.Close()
+
+	h := NewHub([]Config{{Url: healthy.URL}, {Url: degraded.URL}, {Url: unreachable.URL}})
+	for _, v := range h.Status() {
+		if v.State != HealthStateUnknown {
+			t.Errorf("hub.Status() %s = %v before the first check, want %v", v.Url, v.State, HealthStateUnknown)
+		}
+	}
+	if _, err := h.Get(unreachable.URL, SkipUnhealthy()); err != nil {
+		t.Errorf("hub.Get() error = %v, the unchecked harbor was skipped", err)
+	}
+
+	h.CheckHealth()
+	want := map[string]HealthState{
+		healthy.URL:     HealthStateHealthy,
+		degraded.URL:    HealthStateDegraded,
+		unreachable.URL: HealthStateUnreachable,
+	}
+	status := h.Status()
+	if len(status) != len(want) {
+		t.Fatalf("hub.Status() = %v, want %d harbors", status, len(want))
+	}
+	for i, v := range status {
+		if i > 0 && status[i-1].Url > v.Url {
+			t.Errorf("hub.Status() was not sorted by url")
+		}
+		if v.State != want[v.Url] {
+			t.Errorf("hub.Status() %s = %v, want %v", v.Url, v.State, want[v.Url])
+		}
+		if v.LastCheck.IsZero() {
+			t.Errorf("hub.Status() %s has no LastCheck", v.Url)
+		}
+		switch v.State {
+		case HealthStateHealthy:
+			if v.Version != "v2.2.0-6de2c8e6" || v.LastError != "" {
+				t.Errorf("hub.Status() %s version = %v, lastError = %v", v.Url, v.Version, v.LastError)
+			}
+		case HealthStateDegraded:
+			if v.LastError != "error: unhealthy components:trivy" {
+				t.Errorf("hub.Status() %s lastError = %v", v.Url, v.LastError)
+			}
+		case HealthStateUnreachable:
+			if v.LastError == "" {
+				t.Errorf("hub.Status() %s has no lastError", v.Url)
+			}
+		}
+	}
+
+	if _, err := h.Get(unreachable.URL, SkipUnhealthy()); err == nil {
+		t.Errorf("hub.Get() returned the unreachable harbor with SkipUnhealthy")
+	}
+	if _, err := h.Get(unreachable.URL); err != nil {
+		t.Errorf("hub.Get() error = %v without SkipUnhealthy", err)
+	}
+	if _, err := h.Get(degraded.URL, SkipUnhealthy()); err != nil {
+		t.Errorf("hub.Get() error = %v, the degraded harbor was skipped", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	h.RunHealthChecks(ctx, time.Millisecond*10)
+}
@@ -1,74 +1,345 @@
 package harbor_api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	"github.com/goharbor/harbor/src/controller/artifact"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/watch"
+	"net"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	ErrorHarborUrlWasNotExisted = "error: the harbor url:%s was not existed"
+	ErrorHarborUrlWasExisted    = "error: the harbor url:%s was already existed"
+	ErrorHubWasClosed           = "error: the hub was closed"
+	ErrorImageWithoutHost       = "error: the image:%s has no registry host"
+	ErrorImageWithoutTag        = "error: the image:%s has no tag to watch"
 
 	HttpPrefix  = "http://"
 	HttpsPrefix = "https://"
 )
 
+var (
+	schemeRegexp = regexp.MustCompile(fmt.Sprintf(`^(?:%s|%s)`, HttpPrefix, HttpsPrefix))
+)
+
 type HubGetter interface {
 	HarborHub() HubInterface
 }
 
 type HubInterface interface {
 	List() []string
-	Get(url string) (HarborInterface, error)
+	// Get accepts a bare host, a full url or an image reference, and returns the harbor of the same host
+	Get(url string, opts ...GetOption) (HarborInterface, error)
+	// ResolveImage finds the harbor by the registry host of the image, and returns the artifact of its tag or digest,
+	// it fails over to the mirrors of the harbor
+	ResolveImage(image string) (artifact.Artifact, error)
+	// WatchImage finds the harbor by the registry host of the image, and watches its tag
+	WatchImage(image string) (watch.Interface, error)
+	// Add adds a new harbor, the host must not be existed
+	Add(c Config) error
+	// Update replaces the existed harbor of the same host, and shuts down the watches of the old one
+	Update(c Config) error
+	// Remove removes the harbor, and shuts down its watches
+	Remove(url string) error
+	// Reconcile adds, removes and updates the harbors to match the configs, the harbors whose
+	// credentials or mirrors were the only change were updated in place and keep their watches
+	Reconcile(c []Config) error
+	// CheckHealth checks the health and the systeminfo api of all the harbors once
+	CheckHealth()
+	// RunHealthChecks checks all the harbors every interval until ctx was done
+	RunHealthChecks(ctx context.Context, interval time.Duration)
+	// Status returns the last health check of all the harbors, sorted by their urls
+	Status() []HarborStatus
+	// Search searches all the harbors concurrently, and merges the results tagged with their urls
+	Search(ctx context.Context, query string) HubSearchResult
+	// References resolves the artifact from the harbor or its mirrors, the healthy and the nearest first, and fails over on the transport errors and 5xx
+	References(url, projectName, repositoryName, digestOrTag string) (artifact.Artifact, error)
+	// Artifacts lists the artifacts from the harbor or its mirrors, the healthy and the nearest first, and fails over on the transport errors and 5xx
+	Artifacts(url, projectName, repositoryName string) ([]artifact.Artifact, error)
+	// VerifyDigest resolves the artifact from the harbor and all of its mirrors, and reports whether their digests were the same
+	VerifyDigest(url, projectName, repositoryName, digestOrTag string) (DigestVerification, error)
+	// Diff compares the projects, the repositories and the tags of the destination with the source,
+	// and reports the missing repositories, the missing tags and the tags whose digests were different
+	Diff(srcURL, dstURL string, opts DiffOptions) (*DiffReport, error)
+	// Close removes all the harbors and shuts down their watches, the hub can't be added to any more
+	Close() error
 }
 
 type hub struct {
-	harbors map[string]HarborInterface
+	mu     sync.RWMutex
+	closed bool
+	// harbors were keyed by the canonical host of their urls, see NormalizeHost
+	harbors map[string]*hubHarbor
+}
+
+type hubHarbor struct {
+	url    string
+	config Config
+	harbor HarborInterface
+	// page lists the first page of the artifacts, it was the ListHandler of the batch polling through the hub
+	page   ListHandler
+	status HarborStatus
 }
 
 type Config struct {
 	Url      string `json:"url"`
 	Admin    string `json:"admin"`
 	Password string `json:"password"`
+	// PasswordFile was read into Password by LoadHubConfig, such as a key of a mounted Kubernetes Secret
+	PasswordFile string `json:"passwordFile,omitempty"`
+	// Mirrors were the urls of the other harbors inside the hub which replicate from this one,
+	// the reads through the hub and the watches of this harbor fail over to them
+	Mirrors []string `json:"mirrors,omitempty"`
+	// RegistryPolling polls the watched tags by the manifest HEAD of the registry, see HarborOptions
+	RegistryPolling bool `json:"registryPolling,omitempty"`
+}
+
+// newHubHarbor creates the harbor whose watches were polled through the hub, so that they fail over to the mirrors
+func (h *hub) newHubHarbor(c Config) *hubHarbor {
+	url := NormalizeUrl(c.Url)
+	key := NormalizeHost(c.Url)
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		return h.references(key, true, projectName, repositoryName, digestOrTag)
+	}
+	list := func(projectName string, repositoryName string) ([]artifact.Artifact, error) {
+		return h.artifacts(key, true, true, projectName, repositoryName)
+	}
+	opts := make([]HarborOption, 0)
+	if c.RegistryPolling {
+		opts = append(opts, WithRegistryPolling())
+	}
+	t := newHarbor(url, c.Admin, c.Password, handler, list, opts...)
+	return &hubHarbor{
+		url:    url,
+		config: c,
+		harbor: t,
+		page:   t.artifactsPage,
+	}
 }
 
 func NewHub(c []Config) HubInterface {
 	h := &hub{
-		harbors: make(map[string]HarborInterface, 0),
+		harbors: make(map[string]*hubHarbor, 0),
 	}
+	// the duplicated hosts were resolved before creating the harbors, whose watches would leak once replaced
+	configs := make(map[string]Config, len(c))
 	for _, v := range c {
-		h.harbors[v.Url] = NewHarbor(v.Url, v.Admin, v.Password)
+		key := NormalizeHost(v.Url)
+		if _, ok := configs[key]; ok {
+			zaplogger.Sugar().Warnw("duplicated harbor host, the latter config wins", "host", key, "url", v.Url)
+		}
+		configs[key] = v
+	}
+	for key, v := range configs {
+		h.harbors[key] = h.newHubHarbor(v)
 	}
 	return h
 }
 
+// List returns the sorted urls of the harbors
 func (h *hub) List() []string {
-	res := make([]string, 0)
-	for k := range h.harbors {
-		res = append(res, k)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	res := make([]string, 0, len(h.harbors))
+	for _, v := range h.harbors {
+		res = append(res, v.url)
 	}
+	sort.Strings(res)
 	return res
 }
 
-func (h *hub) Get(url string) (HarborInterface, error) {
-	s := ConvertUrlToHttp(url)
-	if t, ok := h.harbors[s]; ok {
-		return t, nil
+func (h *hub) Get(url string, opts ...GetOption) (HarborInterface, error) {
+	o := &GetOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	t, ok := h.harbors[NormalizeHost(url)]
+	if !ok {
+		return nil, fmt.Errorf(ErrorHarborUrlWasNotExisted, url)
+	}
+	if o.SkipUnhealthy && t.status.State == HealthStateUnreachable {
+		return nil, fmt.Errorf(ErrorHarborWasUnreachable, url, t.status.LastError)
+	}
+	return t.harbor, nil
+}
+
+func (h *hub) Add(c Config) error {
+	key := NormalizeHost(c.Url)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return errors.New(ErrorHubWasClosed)
+	}
+	if _, ok := h.harbors[key]; ok {
+		return fmt.Errorf(ErrorHarborUrlWasExisted, c.Url)
+	}
+	h.harbors[key] = h.newHubHarbor(c)
+	return nil
+}
+
+func (h *hub) Update(c Config) error {
+	key := NormalizeHost(c.Url)
+	h.mu.Lock()
+	old, ok := h.harbors[key]
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf(ErrorHarborUrlWasNotExisted, c.Url)
 	}
-	s = ConvertUrlToHttps(url)
-	if t, ok := h.harbors[s]; ok {
-		return t, nil
+	h.harbors[key] = h.newHubHarbor(c)
+	h.mu.Unlock()
+	// the watches were shut down outside the lock, since it waits for the polling goroutines
+	return old.harbor.Close(context.Background())
+}
+
+func (h *hub) Remove(url string) error {
+	key := NormalizeHost(url)
+	h.mu.Lock()
+	old, ok := h.harbors[key]
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf(ErrorHarborUrlWasNotExisted, url)
+	}
+	delete(h.harbors, key)
+	h.mu.Unlock()
+	return old.harbor.Close(context.Background())
+}
+
+func (h *hub) Reconcile(c []Config) error {
+	desired := make(map[string]Config, len(c))
+	for _, v := range c {
+		desired[NormalizeHost(v.Url)] = v
+	}
+	h.mu.RLock()
+	current := make(map[string]hubHarbor, len(h.harbors))
+	for k, v := range h.harbors {
+		current[k] = *v
+	}
+	h.mu.RUnlock()
+	errs := make([]error, 0)
+	for k, v := range current {
+		if _, ok := desired[k]; !ok {
+			if err := h.Remove(v.url); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for k, v := range desired {
+		old, ok := current[k]
+		var err error
+		switch {
+		case !ok:
+			err = h.Add(v)
+		case old.url != NormalizeUrl(v.Url) || old.config.RegistryPolling != v.RegistryPolling:
+			err = h.Update(v)
+		case !reflect.DeepEqual(old.config, v):
+			// the credentials and the mirrors were changed in place
+			old.harbor.SetCredentials(v.Admin, v.Password)
+			h.mu.Lock()
+			if t, ok := h.harbors[k]; ok && t.harbor == old.harbor {
+				t.config = v
+			}
+			h.mu.Unlock()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (h *hub) Close() error {
+	h.mu.Lock()
+	harbors := h.harbors
+	h.harbors = make(map[string]*hubHarbor, 0)
+	h.closed = true
+	h.mu.Unlock()
+	errs := make([]error, 0)
+	for _, v := range harbors {
+		if err := v.harbor.Close(context.Background()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (h *hub) ResolveImage(image string) (res artifact.Artifact, err error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return res, err
+	}
+	if ref.Host == "" {
+		return res, fmt.Errorf(ErrorImageWithoutHost, image)
+	}
+	digestOrTag := ref.Tag
+	if ref.Digest != "" {
+		digestOrTag = ref.Digest
+	}
+	return h.References(ref.Host, ref.Project, ref.Repository, digestOrTag)
+}
+
+func (h *hub) WatchImage(image string) (watch.Interface, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Host == "" {
+		return nil, fmt.Errorf(ErrorImageWithoutHost, image)
+	}
+	if ref.Tag == "" {
+		return nil, fmt.Errorf(ErrorImageWithoutTag, image)
+	}
+	t, err := h.Get(ref.Host)
+	if err != nil {
+		return nil, err
+	}
+	return t.Watch(ref.Option())
+}
+
+// NormalizeHost returns the lowercase host of a url, a registry host or an image reference, without the scheme,
+// the path and the default ports, so that https://Harbor.domain.com:443/ and harbor.domain.com were the same
+func NormalizeHost(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+len("://"):]
+	}
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.ToLower(s)
+	if host, port, err := net.SplitHostPort(s); err == nil && (port == "80" || port == "443") {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return s
+}
+
+// NormalizeUrl returns the url with https:// if it has no scheme, and without the trailing slashes
+func NormalizeUrl(url string) string {
+	url = strings.TrimRight(strings.TrimSpace(url), "/")
+	if !schemeRegexp.MatchString(url) {
+		url = HttpsPrefix + url
 	}
-	return nil, fmt.Errorf(ErrorHarborUrlWasNotExisted, url)
+	return url
 }
 
 func ConvertUrlToHttp(in string) string {
-	re := regexp.MustCompile(fmt.Sprintf(`%s|%s`, HttpPrefix, HttpsPrefix))
-	out := re.ReplaceAll([]byte(in), []byte(HttpPrefix))
-	return string(out)
+	return schemeRegexp.ReplaceAllString(in, HttpPrefix)
 }
 
 func ConvertUrlToHttps(in string) string {
-	re := regexp.MustCompile(fmt.Sprintf(`%s|%s`, HttpPrefix, HttpsPrefix))
-	out := re.ReplaceAll([]byte(in), []byte(HttpsPrefix))
-	return string(out)
+	return schemeRegexp.ReplaceAllString(in, HttpsPrefix)
 }
@@ -1,8 +1,16 @@
 package harbor_api
 
 import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var fakeConfig2 = []Config{
@@ -38,6 +46,33 @@ func TestNewHub(t *testing.T) {
 	}
 }
 
+func TestNewHub_Duplicated(t *testing.T) {
+	// the duplicated config must not start the scheduler and the workers of a harbor which was replaced at once,
+	// so that it starts as many goroutines as the hub of the same hosts without the duplicated one
+	before := runtime.NumGoroutine()
+	single := NewHub(fakeConfig2)
+	started := runtime.NumGoroutine() - before
+	defer single.Close()
+	before = runtime.NumGoroutine()
+	h := NewHub(append(fakeConfig2, Config{Url: "www.domain1.com/", Admin: "latter", Password: "pwd2"}))
+	if got := runtime.NumGoroutine() - before; got > started {
+		t.Errorf("NewHub() started %d goroutines, want at most %d", got, started)
+	}
+	if got, want := h.List(), []string{"http://111.222.333.11:8863", "https://www.domain1.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hub.List() = %v, want %v", got, want)
+	}
+	c, err := h.Get("https://www.domain1.com")
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+	if admin, password := c.(*harbor).credentials(); admin != "latter" || password != "pwd2" {
+		t.Errorf("hub.Get() credentials = %v %v, want the latter config", admin, password)
+	}
+	if err = h.Close(); err != nil {
+		t.Fatalf("hub.Close() error = %v", err)
+	}
+}
+
 func Test_hub_List(t *testing.T) {
 	type fields struct {
 		harbors map[string]HarborInterface
@@ -49,13 +84,13 @@ func Test_hub_List(t *testing.T) {
 	}{
 		{
 			name: "Test_hub_List_1",
-			want: []string{},
+			want: []string{"http://111.222.333.11:8863", "https://harbor.domain.com", "https://www.domain1.com"},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := NewHub(fakeConfig2)
-			if got := h.List(); len(got) != len(fakeConfig2) {
+			h := NewHub(append(fakeConfig2, Config{Url: "harbor.domain.com/"}))
+			if got := h.List(); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("hub.List() = %v, want %v", got, tt.want)
 			}
 		})
@@ -104,6 +139,34 @@ func Test_hub_Get(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Test_hub_Get_BareHost",
+			args: args{
+				url: "www.domain1.com",
+			},
+			wantErr: false,
+		},
+		{
+			name: "Test_hub_Get_TrailingSlashAndDefaultPort",
+			args: args{
+				url: "https://WWW.Domain1.com:443/",
+			},
+			wantErr: false,
+		},
+		{
+			name: "Test_hub_Get_ImageReference",
+			args: args{
+				url: "111.222.333.11:8863/proj/team/app:1.2",
+			},
+			wantErr: false,
+		},
+		{
+			name: "Test_hub_Get_OtherPort",
+			args: args{
+				url: "www.domain1.com:8443",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -186,3 +249,175 @@ func TestConvertUrlToHttps(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "TestNormalizeHost_https", in: "https://harbor.domain.com", want: "harbor.domain.com"},
+		{name: "TestNormalizeHost_trailing_slash", in: "http://harbor.domain.com/", want: "harbor.domain.com"},
+		{name: "TestNormalizeHost_default_port", in: "https://Harbor.Domain.com:443", want: "harbor.domain.com"},
+		{name: "TestNormalizeHost_port", in: "harbor.domain.com:8443", want: "harbor.domain.com:8443"},
+		{name: "TestNormalizeHost_path", in: "http://111.222.333.11:8863/api/v2.0", want: "111.222.333.11:8863"},
+		{name: "TestNormalizeHost_ipv6", in: "https://[::1]:443/", want: "[::1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeHost(tt.in); got != tt.want {
+				t.Errorf("NormalizeHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hub_ResolveImage(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v2.0/projects/proj/repositories/team%252Fapp/artifacts/1.2":
+			_, _ = w.Write([]byte(`{"digest":"sha256:27d6aa8f"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	h := NewHub(append([]Config{{Url: s.URL + "/", Admin: "admin", Password: "pwd"}}, fakeConfig2...))
+	host := strings.TrimPrefix(s.URL, HttpPrefix)
+	tests := []struct {
+		name    string
+		image   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "Test_hub_ResolveImage_1",
+			image: host + "/proj/team/app:1.2",
+			want:  "sha256:27d6aa8f",
+		},
+		{
+			name:    "Test_hub_ResolveImage_NotFound",
+			image:   host + "/proj/team/app:1.3",
+			wantErr: true,
+		},
+		{
+			name:    "Test_hub_ResolveImage_UnknownHost",
+			image:   "harbor.domain13333.com/proj/team/app:1.2",
+			wantErr: true,
+		},
+		{
+			name:    "Test_hub_ResolveImage_WithoutHost",
+			image:   "proj/team/app:1.2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.ResolveImage(tt.image)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hub.ResolveImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Digest != tt.want {
+				t.Errorf("hub.ResolveImage() = %v, want %v", got.Digest, tt.want)
+			}
+		})
+	}
+	w, err := h.WatchImage(host + "/proj/team/app:1.2")
+	if err != nil {
+		t.Fatalf("hub.WatchImage() error = %v", err)
+	}
+	w.Stop()
+	if _, err = h.WatchImage("www.domain1.com:443/proj/team/app@sha256:27d6aa8f9d040c5e85c61a093ad2dc769e57440e8240c3294f47093e97d96c9a"); err == nil {
+		t.Errorf("hub.WatchImage() watched an image without tag")
+	}
+}
+
+func Test_hub_Dynamic(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"digest":"sha256:27d6aa8f"}`))
+	}))
+	defer s.Close()
+	h := NewHub(fakeConfig2)
+	if err := h.Add(Config{Url: s.URL, Admin: "admin", Password: "pwd"}); err != nil {
+		t.Fatalf("hub.Add() error = %v", err)
+	}
+	if err := h.Add(Config{Url: s.URL + "/"}); err == nil {
+		t.Errorf("hub.Add() added an existed harbor")
+	}
+	old, err := h.Get(s.URL)
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+	host := strings.TrimPrefix(s.URL, HttpPrefix)
+	w, err := h.WatchImage(host + "/proj/app:latest")
+	if err != nil {
+		t.Fatalf("hub.WatchImage() error = %v", err)
+	}
+
+	if err = h.Update(Config{Url: s.URL, Admin: "admin", Password: "pwd2"}); err != nil {
+		t.Fatalf("hub.Update() error = %v", err)
+	}
+	if got, _ := h.Get(s.URL); got == old {
+		t.Errorf("hub.Update() didn't replace the harbor")
+	}
+	waitClosed := func(w watch.Interface) {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case _, ok := <-w.ResultChan():
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("the watch of the old harbor was not closed")
+			}
+		}
+	}
+	waitClosed(w)
+	if err = h.Update(Config{Url: "harbor.domain13333.com"}); err == nil {
+		t.Errorf("hub.Update() updated a harbor which was not existed")
+	}
+
+	w, err = h.WatchImage(host + "/proj/app:latest")
+	if err != nil {
+		t.Fatalf("hub.WatchImage() error = %v", err)
+	}
+	if err = h.Remove(host); err != nil {
+		t.Fatalf("hub.Remove() error = %v", err)
+	}
+	waitClosed(w)
+	if _, err = h.Get(s.URL); err == nil {
+		t.Errorf("hub.Get() returned a removed harbor")
+	}
+	if err = h.Remove(host); err == nil {
+		t.Errorf("hub.Remove() removed a harbor which was not existed")
+	}
+
+	// the hub was safe for the concurrent reads and writes
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		url := fmt.Sprintf("harbor-%d.domain.com", i)
+		go func() {
+			defer wg.Done()
+			_ = h.Add(Config{Url: url})
+			_ = h.Remove(url)
+		}()
+		go func() {
+			defer wg.Done()
+			_, _ = h.Get(url)
+			_ = h.List()
+		}()
+	}
+	wg.Wait()
+
+	if err = h.Close(); err != nil {
+		t.Fatalf("hub.Close() error = %v", err)
+	}
+	if got := h.List(); len(got) != 0 {
+		t.Errorf("hub.List() = %v after Close", got)
+	}
+	if err = h.Add(Config{Url: s.URL}); err == nil {
+		t.Errorf("hub.Add() added a harbor after Close")
+	}
+}
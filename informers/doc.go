@@ -0,0 +1,4 @@
+// Package informers provides client-go style shared informers and listers for the harbor resources.
+// The informers re-list all the pages of their resources every poll interval, and the artifact informer
+// also re-lists the repository of a watched tag as soon as its image watch reports a change.
+package informers // import "github.com/nevercase/harbor-api/informers"
@@ -0,0 +1,126 @@
+package informers
+
+import (
+	harbor_api "github.com/nevercase/harbor-api"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = time.Second * 30
+)
+
+// NewInformerFunc creates the shared informer of one kind
+type NewInformerFunc func(h harbor_api.HarborInterface, resyncPeriod time.Duration, pollInterval time.Duration) cache.SharedIndexInformer
+
+// SharedInformerOption defines the functional option type for SharedInformerFactory
+type SharedInformerOption func(*sharedInformerFactory) *sharedInformerFactory
+
+// SharedInformerFactory provides the shared informers of the harbor resources
+type SharedInformerFactory interface {
+	Start(stopCh <-chan struct{})
+	WaitForCacheSync(stopCh <-chan struct{}) map[reflect.Type]bool
+	InformerFor(obj runtime.Object, newFunc NewInformerFunc) cache.SharedIndexInformer
+
+	Projects() ProjectInformer
+	Repositories() RepositoryInformer
+	Artifacts() ArtifactInformer
+}
+
+type sharedInformerFactory struct {
+	harbor        harbor_api.HarborInterface
+	lock          sync.Mutex
+	defaultResync time.Duration
+	pollInterval  time.Duration
+
+	informers map[reflect.Type]cache.SharedIndexInformer
+	// startedInformers is used for tracking which informers have been started,
+	// this allows Start() to be called multiple times safely
+	startedInformers map[reflect.Type]bool
+}
+
+// WithPollInterval sets how often the informers re-list harbor for their watches
+func WithPollInterval(interval time.Duration) SharedInformerOption {
+	return func(factory *sharedInformerFactory) *sharedInformerFactory {
+		factory.pollInterval = interval
+		return factory
+	}
+}
+
+func NewSharedInformerFactory(h harbor_api.HarborInterface, defaultResync time.Duration) SharedInformerFactory {
+	return NewSharedInformerFactoryWithOptions(h, defaultResync)
+}
+
+func NewSharedInformerFactoryWithOptions(h harbor_api.HarborInterface, defaultResync time.Duration, options ...SharedInformerOption) SharedInformerFactory {
+	factory := &sharedInformerFactory{
+		harbor:           h,
+		defaultResync:    defaultResync,
+		pollInterval:     defaultPollInterval,
+		informers:        make(map[reflect.Type]cache.SharedIndexInformer),
+		startedInformers: make(map[reflect.Type]bool),
+	}
+	for _, opt := range options {
+		factory = opt(factory)
+	}
+	return factory
+}
+
+// Start initializes all the requested informers
+func (f *sharedInformerFactory) Start(stopCh <-chan struct{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for informerType, informer := range f.informers {
+		if !f.startedInformers[informerType] {
+			go informer.Run(stopCh)
+			f.startedInformers[informerType] = true
+		}
+	}
+}
+
+// WaitForCacheSync waits for the caches of all the started informers to be synced
+func (f *sharedInformerFactory) WaitForCacheSync(stopCh <-chan struct{}) map[reflect.Type]bool {
+	informers := func() map[reflect.Type]cache.SharedIndexInformer {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		informers := map[reflect.Type]cache.SharedIndexInformer{}
+		for informerType, informer := range f.informers {
+			if f.startedInformers[informerType] {
+				informers[informerType] = informer
+			}
+		}
+		return informers
+	}()
+	res := map[reflect.Type]bool{}
+	for informType, informer := range informers {
+		res[informType] = cache.WaitForCacheSync(stopCh, informer.HasSynced)
+	}
+	return res
+}
+
+// InformerFor returns the shared informer of obj, and creates it by newFunc at the first time
+func (f *sharedInformerFactory) InformerFor(obj runtime.Object, newFunc NewInformerFunc) cache.SharedIndexInformer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	informerType := reflect.TypeOf(obj)
+	if informer, ok := f.informers[informerType]; ok {
+		return informer
+	}
+	informer := newFunc(f.harbor, f.defaultResync, f.pollInterval)
+	f.informers[informerType] = informer
+	return informer
+}
+
+func (f *sharedInformerFactory) Projects() ProjectInformer {
+	return &projectInformer{factory: f}
+}
+
+func (f *sharedInformerFactory) Repositories() RepositoryInformer {
+	return &repositoryInformer{factory: f}
+}
+
+func (f *sharedInformerFactory) Artifacts() ArtifactInformer {
+	return &artifactInformer{factory: f}
+}
@@ -0,0 +1,288 @@
+package informers
+
+import (
+	"fmt"
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	harbor_api "github.com/nevercase/harbor-api"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"time"
+)
+
+const (
+	// IndexByProject indexes the repositories and the artifacts by their project, it was the namespace index
+	IndexByProject = cache.NamespaceIndex
+	// IndexByRepository indexes the artifacts by "project/repository"
+	IndexByRepository = "repository"
+	// IndexByDigest indexes the artifacts by their digest
+	IndexByDigest = "digest"
+
+	// watchSyncInterval is how often the artifact informer looks for the image watches to follow
+	watchSyncInterval = time.Second
+)
+
+type ProjectInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() ProjectLister
+}
+
+type RepositoryInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() RepositoryLister
+}
+
+type ArtifactInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() ArtifactLister
+}
+
+type projectInformer struct {
+	factory *sharedInformerFactory
+}
+
+func NewProjectInformer(h harbor_api.HarborInterface, resyncPeriod time.Duration, pollInterval time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		NewPollListWatch(ListProjects(h), pollInterval),
+		&harbor_api.Project{},
+		resyncPeriod,
+		cache.Indexers{},
+	)
+}
+
+func (f *projectInformer) Informer() cache.SharedIndexInformer {
+	return f.factory.InformerFor(&harbor_api.Project{}, NewProjectInformer)
+}
+
+func (f *projectInformer) Lister() ProjectLister {
+	return NewProjectLister(f.Informer().GetIndexer())
+}
+
+type repositoryInformer struct {
+	factory *sharedInformerFactory
+}
+
+func NewRepositoryInformer(h harbor_api.HarborInterface, resyncPeriod time.Duration, pollInterval time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		NewPollListWatch(ListRepositories(h), pollInterval),
+		&harbor_api.Repository{},
+		resyncPeriod,
+		cache.Indexers{IndexByProject: cache.MetaNamespaceIndexFunc},
+	)
+}
+
+func (f *repositoryInformer) Informer() cache.SharedIndexInformer {
+	return f.factory.InformerFor(&harbor_api.Repository{}, NewRepositoryInformer)
+}
+
+func (f *repositoryInformer) Lister() RepositoryLister {
+	return NewRepositoryLister(f.Informer().GetIndexer())
+}
+
+type artifactInformer struct {
+	factory *sharedInformerFactory
+}
+
+func NewArtifactInformer(h harbor_api.HarborInterface, resyncPeriod time.Duration, pollInterval time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		NewPollListWatchWithRefresh(ListArtifacts(h), pollInterval, WatchedArtifacts(h)),
+		&harbor_api.Artifact{},
+		resyncPeriod,
+		cache.Indexers{
+			IndexByProject:    cache.MetaNamespaceIndexFunc,
+			IndexByRepository: artifactRepositoryIndexFunc,
+			IndexByDigest:     artifactDigestIndexFunc,
+		},
+	)
+}
+
+func (f *artifactInformer) Informer() cache.SharedIndexInformer {
+	return f.factory.InformerFor(&harbor_api.Artifact{}, NewArtifactInformer)
+}
+
+func (f *artifactInformer) Lister() ArtifactLister {
+	return NewArtifactLister(f.Informer().GetIndexer())
+}
+
+func repositoryKey(projectName string, repositoryName string) string {
+	return fmt.Sprintf("%s/%s", projectName, repositoryName)
+}
+
+func artifactRepositoryIndexFunc(obj interface{}) ([]string, error) {
+	a, ok := obj.(*harbor_api.Artifact)
+	if !ok {
+		return nil, fmt.Errorf(ErrorUnexpectedObject, obj)
+	}
+	return []string{repositoryKey(a.Spec.Project, a.Spec.Repository)}, nil
+}
+
+func artifactDigestIndexFunc(obj interface{}) ([]string, error) {
+	a, ok := obj.(*harbor_api.Artifact)
+	if !ok {
+		return nil, fmt.Errorf(ErrorUnexpectedObject, obj)
+	}
+	return []string{a.Spec.Digest}, nil
+}
+
+// ListProjects lists all the projects as *harbor_api.ProjectList
+func ListProjects(h harbor_api.HarborInterface) ListFunc {
+	return func() (runtime.Object, error) {
+		projects, err := h.Projects()
+		if err != nil {
+			return nil, err
+		}
+		res := &harbor_api.ProjectList{Items: make([]harbor_api.Project, 0, len(projects))}
+		for _, p := range projects {
+			res.Items = append(res.Items, *harbor_api.NewProject(p))
+		}
+		return res, nil
+	}
+}
+
+// ListRepositories lists the repositories of all the projects as *harbor_api.RepositoryList
+func ListRepositories(h harbor_api.HarborInterface) ListFunc {
+	return func() (runtime.Object, error) {
+		projects, err := h.Projects()
+		if err != nil {
+			return nil, err
+		}
+		res := &harbor_api.RepositoryList{Items: make([]harbor_api.Repository, 0)}
+		for _, p := range projects {
+			repositories, err := h.Repositories(p.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range repositories {
+				res.Items = append(res.Items, *harbor_api.NewRepository(p.Name, r))
+			}
+		}
+		return res, nil
+	}
+}
+
+// ListArtifacts lists the artifacts of all the repositories as *harbor_api.ArtifactList
+func ListArtifacts(h harbor_api.HarborInterface) ListFunc {
+	repositories := ListRepositories(h)
+	return func() (runtime.Object, error) {
+		list, err := repositories()
+		if err != nil {
+			return nil, err
+		}
+		res := &harbor_api.ArtifactList{Items: make([]harbor_api.Artifact, 0)}
+		for _, r := range list.(*harbor_api.RepositoryList).Items {
+			artifacts, err := ListRepositoryArtifacts(h, r.Spec.Project, r.Spec.Name)()
+			if err != nil {
+				return nil, err
+			}
+			res.Items = append(res.Items, artifacts.(*harbor_api.ArtifactList).Items...)
+		}
+		return res, nil
+	}
+}
+
+// ListRepositoryArtifacts lists the artifacts of one repository as *harbor_api.ArtifactList
+func ListRepositoryArtifacts(h harbor_api.HarborInterface, projectName string, repositoryName string) ListFunc {
+	return func() (runtime.Object, error) {
+		artifacts, err := h.Artifacts(projectName, repositoryName)
+		if err != nil {
+			return nil, err
+		}
+		res := &harbor_api.ArtifactList{Items: make([]harbor_api.Artifact, 0, len(artifacts))}
+		for _, a := range artifacts {
+			res.Items = append(res.Items, *harbor_api.NewArtifact(projectName, repositoryName, a))
+		}
+		return res, nil
+	}
+}
+
+// WatchedArtifacts follows the image watches of HarborInterface.Watch, and re-lists the repository of a tag
+// once its watch reports a change, so that the watched tags were updated between the polls.
+// The informer attaches by HarborInterface.Follow, which neither counts as a watcher nor starts a torn down
+// watch again, so that it never keeps an idle image from expiring, even with the other informers following it.
+func WatchedArtifacts(h harbor_api.HarborInterface) RefreshFunc {
+	return func(stopCh <-chan struct{}) <-chan Refresh {
+		ch := make(chan Refresh)
+		go followWatches(h, ch, stopCh)
+		return ch
+	}
+}
+
+type followedWatch struct {
+	h harbor_api.HarborInterface
+	w watch.Interface
+	// done was closed once the events of the watch were drained, such as after the image was torn down
+	done chan struct{}
+}
+
+func followWatches(h harbor_api.HarborInterface, ch chan<- Refresh, stopCh <-chan struct{}) {
+	followed := make(map[string]*followedWatch)
+	defer func() {
+		for _, v := range followed {
+			v.w.Stop()
+		}
+	}()
+	tick := time.NewTicker(watchSyncInterval)
+	defer tick.Stop()
+	for {
+		active := make(map[string]bool)
+		for _, s := range h.ListWatches() {
+			v, ok := followed[s.Name]
+			if ok {
+				select {
+				case <-v.done:
+					// the image was torn down, and may have been watched again under the same name
+					v.w.Stop()
+					delete(followed, s.Name)
+					ok = false
+				default:
+				}
+			}
+			// the followers, including the informer itself, were not counted in the watchers
+			if s.Watchers > 0 {
+				active[s.Name] = true
+			}
+			if ok || !active[s.Name] {
+				continue
+			}
+			w, err := h.Follow(s.Name)
+			if err != nil {
+				zaplogger.Sugar().Errorw("informer follow failed", "image", s.Name, "err", err)
+				continue
+			}
+			v = &followedWatch{h: h, w: w, done: make(chan struct{})}
+			followed[s.Name] = v
+			go v.forward(ch, stopCh)
+		}
+		for name, v := range followed {
+			if !active[name] {
+				v.w.Stop()
+				delete(followed, name)
+			}
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// forward sends the repository of each digest change as a Refresh, the errors were left to the polls
+func (v *followedWatch) forward(ch chan<- Refresh, stopCh <-chan struct{}) {
+	defer close(v.done)
+	for e := range v.w.ResultChan() {
+		c, ok := e.Object.(*harbor_api.ImageDigestChange)
+		if !ok {
+			continue
+		}
+		r := Refresh{
+			Prefix: repositoryKey(c.Spec.Project, c.Spec.Repository) + "@",
+			List:   ListRepositoryArtifacts(v.h, c.Spec.Project, c.Spec.Repository),
+		}
+		select {
+		case ch <- r:
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package informers
+
+import (
+	"context"
+	"github.com/goharbor/harbor/src/common/models"
+	"github.com/goharbor/harbor/src/controller/artifact"
+	"github.com/goharbor/harbor/src/controller/tag"
+	harbor_api "github.com/nevercase/harbor-api"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHarbor serves the projects, repositories and artifacts from memory,
+// and the image watches by the real Images polling the tags of artifacts
+type fakeHarbor struct {
+	harbor_api.HarborInterface
+
+	mu sync.Mutex
+	// artifacts were keyed by project, repository and then digest, the values were the tags
+	artifacts map[string]map[string]map[string][]string
+	images    harbor_api.Images
+	// followed receives the image name once an informer followed its watch
+	followed chan string
+}
+
+func (h *fakeHarbor) ListWatches() []harbor_api.WatchStatus {
+	return h.images.ListWatches()
+}
+
+func (h *fakeHarbor) Follow(name string) (watch.Interface, error) {
+	w, err := h.images.Follow(name)
+	if err == nil {
+		h.followed <- name
+	}
+	return w, err
+}
+
+// reference resolves the tag for the polls of images
+func (h *fakeHarbor) reference(projectName string, repositoryName string, tag string) (res artifact.Artifact, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for digest, tags := range h.artifacts[projectName][repositoryName] {
+		for _, name := range tags {
+			if name == tag {
+				res.Digest = digest
+				return res, nil
+			}
+		}
+	}
+	return res, &harbor_api.StatusError{Code: http.StatusNotFound}
+}
+
+func (h *fakeHarbor) set(projectName, repositoryName, digest string, tags ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.artifacts[projectName]; !ok {
+		h.artifacts[projectName] = make(map[string]map[string][]string)
+	}
+	if _, ok := h.artifacts[projectName][repositoryName]; !ok {
+		h.artifacts[projectName][repositoryName] = make(map[string][]string)
+	}
+	if tags == nil {
+		delete(h.artifacts[projectName][repositoryName], digest)
+		return
+	}
+	h.artifacts[projectName][repositoryName][digest] = tags
+}
+
+func (h *fakeHarbor) Projects() (res []models.Project, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name := range h.artifacts {
+		res = append(res, models.Project{Name: name})
+	}
+	return res, nil
+}
+
+func (h *fakeHarbor) Repositories(projectName string) (res []models.RepoRecord, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name := range h.artifacts[projectName] {
+		res = append(res, models.RepoRecord{Name: projectName + "/" + name})
+	}
+	return res, nil
+}
+
+func (h *fakeHarbor) Artifacts(projectName string, repositoryName string) (res []artifact.Artifact, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for digest, tags := range h.artifacts[projectName][repositoryName] {
+		a := artifact.Artifact{}
+		a.Digest = digest
+		for _, name := range tags {
+			t := &tag.Tag{}
+			t.Name = name
+			a.Tags = append(a.Tags, t)
+		}
+		res = append(res, a)
+	}
+	return res, nil
+}
+
+// newFakeHarbor polls the image watches by the fake clock of c, the caller closes the images
+func newFakeHarbor(c harbor_api.ImagesConfig) *fakeHarbor {
+	h := &fakeHarbor{
+		artifacts: make(map[string]map[string]map[string][]string),
+		followed:  make(chan string, 10),
+	}
+	h.images = harbor_api.NewImagesWithConfig(context.Background(), h.reference, c)
+	h.set("project-1", "repo-1", "sha256:a", "latest", "v1")
+	h.set("project-1", "repo-2", "sha256:b", "latest")
+	h.set("project-2", "library/repo-1", "sha256:a", "v1")
+	return h
+}
+
+func TestSharedInformerFactory_Listers(t *testing.T) {
+	h := newFakeHarbor(harbor_api.ImagesConfig{Clock: clock.NewFakeClock(time.Now())})
+	defer h.images.Close(context.Background())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory := NewSharedInformerFactory(h, 0)
+	projects := factory.Projects().Lister()
+	repositories := factory.Repositories().Lister()
+	artifacts := factory.Artifacts().Lister()
+	factory.Start(stopCh)
+	for k, v := range factory.WaitForCacheSync(stopCh) {
+		if !v {
+			t.Fatalf("WaitForCacheSync() %v not synced", k)
+		}
+	}
+
+	if list, err := projects.List(labels.Everything()); err != nil || len(list) != 2 {
+		t.Errorf("ProjectLister.List() = %v, %v, want 2 projects", len(list), err)
+	}
+	if _, err := projects.Get("project-3"); !errors.IsNotFound(err) {
+		t.Errorf("ProjectLister.Get() error = %v, want NotFound", err)
+	}
+	if list, err := repositories.ByProject("project-1"); err != nil || len(list) != 2 {
+		t.Errorf("RepositoryLister.ByProject() = %v, %v, want 2 repositories", len(list), err)
+	}
+	if r, err := repositories.Get("project-2", "library/repo-1"); err != nil || r.Spec.Name != "library/repo-1" {
+		t.Errorf("RepositoryLister.Get() = %v, %v", r, err)
+	}
+	if list, err := artifacts.ByDigest("sha256:a"); err != nil || len(list) != 2 {
+		t.Errorf("ArtifactLister.ByDigest() = %v, %v, want 2 artifacts", len(list), err)
+	}
+	if list, err := artifacts.ByRepository("project-1", "repo-2"); err != nil || len(list) != 1 {
+		t.Errorf("ArtifactLister.ByRepository() = %v, %v, want 1 artifact", len(list), err)
+	}
+	if a, err := artifacts.ByTag("project-1", "repo-1", "v1"); err != nil || a.Spec.Digest != "sha256:a" {
+		t.Errorf("ArtifactLister.ByTag() = %v, %v", a, err)
+	}
+	if _, err := artifacts.ByTag("project-1", "repo-1", "v2"); !errors.IsNotFound(err) {
+		t.Errorf("ArtifactLister.ByTag() error = %v, want NotFound", err)
+	}
+}
+
+func TestSharedInformerFactory_EventHandlers(t *testing.T) {
+	h := newFakeHarbor(harbor_api.ImagesConfig{Clock: clock.NewFakeClock(time.Now())})
+	defer h.images.Close(context.Background())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory := NewSharedInformerFactoryWithOptions(h, 0, WithPollInterval(time.Millisecond*10))
+	added, updated, deleted := make(chan *harbor_api.Artifact, 10), make(chan *harbor_api.Artifact, 10), make(chan *harbor_api.Artifact, 10)
+	factory.Artifacts().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			added <- obj.(*harbor_api.Artifact)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if o, n := oldObj.(*harbor_api.Artifact), newObj.(*harbor_api.Artifact); o.ResourceVersion != n.ResourceVersion || len(o.Spec.Tags) != len(n.Spec.Tags) {
+				updated <- n
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			deleted <- obj.(*harbor_api.Artifact)
+		},
+	})
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	receiveArtifact(t, added, "sha256:b")
+
+	h.set("project-1", "repo-2", "sha256:c", "latest")
+	receiveArtifact(t, added, "sha256:c")
+
+	h.set("project-1", "repo-1", "sha256:a", "latest")
+	receiveArtifact(t, updated, "sha256:a")
+
+	h.set("project-1", "repo-2", "sha256:b")
+	receiveArtifact(t, deleted, "sha256:b")
+}
+
+// receiveArtifact waits for the artifact of the digest from ch
+func receiveArtifact(t *testing.T, ch chan *harbor_api.Artifact, digest string) {
+	for {
+		select {
+		case a := <-ch:
+			if a.Spec.Digest == digest {
+				return
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("no event of %s", digest)
+		}
+	}
+}
+
+// waitFollowed waits until the informers followed the image watch n times
+func waitFollowed(t *testing.T, h *fakeHarbor, name string, n int) {
+	for ; n > 0; n-- {
+		select {
+		case got := <-h.followed:
+			if got != name {
+				t.Fatalf("followed %v, want %v", got, name)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("the informer didn't follow the image watch")
+		}
+	}
+}
+
+func TestSharedInformerFactory_WatchedArtifacts(t *testing.T) {
+	fc := clock.NewFakeClock(time.Now())
+	h := newFakeHarbor(harbor_api.ImagesConfig{Policy: harbor_api.Policy{Interval: time.Minute, Jitter: -1}, Clock: fc})
+	defer h.images.Close(context.Background())
+	opt := harbor_api.Option{Project: "project-1", Repository: "repo-1", Tag: "latest", Sha256: "sha256:a"}
+	i, err := h.images.Image(opt)
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := i.Watch()
+	defer w.Stop()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	// the polls of the informer never come during the test, the changes were pushed by the image watch
+	factory := NewSharedInformerFactoryWithOptions(h, 0, WithPollInterval(time.Hour))
+	added := make(chan *harbor_api.Artifact, 10)
+	factory.Artifacts().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			added <- obj.(*harbor_api.Artifact)
+		},
+	})
+	artifacts := factory.Artifacts().Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+	waitFollowed(t, h, opt.ImageName(), 1)
+	if s := h.images.ListWatches(); len(s) != 1 || s[0].Watchers != 1 || s[0].Followers != 1 {
+		t.Errorf("Images.ListWatches() = %+v, want 1 watcher and 1 follower", s)
+	}
+
+	h.set("project-1", "repo-1", "sha256:a", "v1")
+	h.set("project-1", "repo-1", "sha256:d", "latest")
+	fc.Step(time.Minute)
+	receiveArtifact(t, added, "sha256:d")
+	if a, err := artifacts.ByTag("project-1", "repo-1", "latest"); err != nil || a.Spec.Digest != "sha256:d" {
+		t.Errorf("ArtifactLister.ByTag() = %v, %v, want sha256:d", a, err)
+	}
+	if a, err := artifacts.ByTag("project-1", "repo-1", "v1"); err != nil || a.Spec.Digest != "sha256:a" {
+		t.Errorf("ArtifactLister.ByTag() = %v, %v, want sha256:a", a, err)
+	}
+	// the other repositories were left to the polls
+	if list, err := artifacts.ByRepository("project-1", "repo-2"); err != nil || len(list) != 1 {
+		t.Errorf("ArtifactLister.ByRepository() = %v, %v, want 1 artifact", len(list), err)
+	}
+}
+
+func TestSharedInformerFactory_WatchedArtifacts_Idle(t *testing.T) {
+	fc := clock.NewFakeClock(time.Now())
+	h := newFakeHarbor(harbor_api.ImagesConfig{Policy: harbor_api.Policy{Interval: time.Second, Jitter: -1, IdleTimeout: time.Second * 3}, Clock: fc})
+	defer h.images.Close(context.Background())
+	opt := harbor_api.Option{Project: "project-1", Repository: "repo-1", Tag: "latest", Sha256: "sha256:a"}
+	i, err := h.images.Image(opt)
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := i.Watch()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for n := 0; n < 2; n++ {
+		factory := NewSharedInformerFactoryWithOptions(h, 0, WithPollInterval(time.Hour))
+		factory.Artifacts().Informer()
+		factory.Start(stopCh)
+		factory.WaitForCacheSync(stopCh)
+	}
+	waitFollowed(t, h, opt.ImageName(), 2)
+	if s := h.images.ListWatches(); len(s) != 1 || s[0].Watchers != 1 || s[0].Followers != 2 {
+		t.Errorf("Images.ListWatches() = %+v, want 1 watcher and 2 followers", s)
+	}
+	follower, err := h.images.Follow(opt.ImageName())
+	if err != nil {
+		t.Fatalf("Images.Follow() error = %v", err)
+	}
+
+	// the followers keep neither the image nor each other alive once the real watcher left
+	w.Stop()
+	fc.Step(time.Second * 3)
+	e, ok := <-follower.ResultChan()
+	if s, isStatus := e.Object.(*metav1.Status); !ok || e.Type != watch.Error || !isStatus || s.Reason != metav1.StatusReasonExpired {
+		t.Errorf("event = %v, want watch.Error with the Expired reason", e)
+	}
+	if _, ok = <-follower.ResultChan(); ok {
+		t.Errorf("ResultChan was not closed after the watch expired")
+	}
+	if s := h.images.ListWatches(); len(s) != 0 {
+		t.Errorf("Images.ListWatches() = %+v, want none", s)
+	}
+	if _, err = h.Follow(opt.ImageName()); err == nil {
+		t.Errorf("fakeHarbor.Follow() error = nil, want the watch was not existed")
+	}
+}
@@ -0,0 +1,149 @@
+package informers
+
+import (
+	harbor_api "github.com/nevercase/harbor-api"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	ErrorUnexpectedObject = "error: unexpected object:%#v"
+)
+
+// ProjectLister lists the projects from the local cache of the informer
+type ProjectLister interface {
+	List(selector labels.Selector) ([]*harbor_api.Project, error)
+	Get(name string) (*harbor_api.Project, error)
+}
+
+type projectLister struct {
+	indexer cache.Indexer
+}
+
+func NewProjectLister(indexer cache.Indexer) ProjectLister {
+	return &projectLister{indexer: indexer}
+}
+
+func (l *projectLister) List(selector labels.Selector) (res []*harbor_api.Project, err error) {
+	err = cache.ListAll(l.indexer, selector, func(m interface{}) {
+		res = append(res, m.(*harbor_api.Project))
+	})
+	return res, err
+}
+
+func (l *projectLister) Get(name string) (*harbor_api.Project, error) {
+	obj, exists, err := l.indexer.GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(harbor_api.Resource("projects"), name)
+	}
+	return obj.(*harbor_api.Project), nil
+}
+
+// RepositoryLister lists the repositories from the local cache of the informer
+type RepositoryLister interface {
+	List(selector labels.Selector) ([]*harbor_api.Repository, error)
+	ByProject(projectName string) ([]*harbor_api.Repository, error)
+	Get(projectName string, repositoryName string) (*harbor_api.Repository, error)
+}
+
+type repositoryLister struct {
+	indexer cache.Indexer
+}
+
+func NewRepositoryLister(indexer cache.Indexer) RepositoryLister {
+	return &repositoryLister{indexer: indexer}
+}
+
+func (l *repositoryLister) List(selector labels.Selector) (res []*harbor_api.Repository, err error) {
+	err = cache.ListAll(l.indexer, selector, func(m interface{}) {
+		res = append(res, m.(*harbor_api.Repository))
+	})
+	return res, err
+}
+
+func (l *repositoryLister) ByProject(projectName string) (res []*harbor_api.Repository, err error) {
+	err = cache.ListAllByNamespace(l.indexer, projectName, labels.Everything(), func(m interface{}) {
+		res = append(res, m.(*harbor_api.Repository))
+	})
+	return res, err
+}
+
+func (l *repositoryLister) Get(projectName string, repositoryName string) (*harbor_api.Repository, error) {
+	key := repositoryKey(projectName, repositoryName)
+	obj, exists, err := l.indexer.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(harbor_api.Resource("repositories"), key)
+	}
+	return obj.(*harbor_api.Repository), nil
+}
+
+// ArtifactLister lists the artifacts from the local cache of the informer
+type ArtifactLister interface {
+	List(selector labels.Selector) ([]*harbor_api.Artifact, error)
+	ByProject(projectName string) ([]*harbor_api.Artifact, error)
+	ByRepository(projectName string, repositoryName string) ([]*harbor_api.Artifact, error)
+	ByDigest(digest string) ([]*harbor_api.Artifact, error)
+	// ByTag returns the artifact which the tag points to
+	ByTag(projectName string, repositoryName string, tag string) (*harbor_api.Artifact, error)
+}
+
+type artifactLister struct {
+	indexer cache.Indexer
+}
+
+func NewArtifactLister(indexer cache.Indexer) ArtifactLister {
+	return &artifactLister{indexer: indexer}
+}
+
+func (l *artifactLister) List(selector labels.Selector) (res []*harbor_api.Artifact, err error) {
+	err = cache.ListAll(l.indexer, selector, func(m interface{}) {
+		res = append(res, m.(*harbor_api.Artifact))
+	})
+	return res, err
+}
+
+func (l *artifactLister) ByProject(projectName string) ([]*harbor_api.Artifact, error) {
+	return l.byIndex(IndexByProject, projectName)
+}
+
+func (l *artifactLister) ByRepository(projectName string, repositoryName string) ([]*harbor_api.Artifact, error) {
+	return l.byIndex(IndexByRepository, repositoryKey(projectName, repositoryName))
+}
+
+func (l *artifactLister) ByDigest(digest string) ([]*harbor_api.Artifact, error) {
+	return l.byIndex(IndexByDigest, digest)
+}
+
+func (l *artifactLister) ByTag(projectName string, repositoryName string, tag string) (*harbor_api.Artifact, error) {
+	list, err := l.ByRepository(projectName, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		for _, t := range a.Spec.Tags {
+			if t == tag {
+				return a, nil
+			}
+		}
+	}
+	return nil, errors.NewNotFound(harbor_api.Resource("artifacts"), repositoryKey(projectName, repositoryName)+":"+tag)
+}
+
+func (l *artifactLister) byIndex(indexName string, value string) ([]*harbor_api.Artifact, error) {
+	objs, err := l.indexer.ByIndex(indexName, value)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*harbor_api.Artifact, 0, len(objs))
+	for _, m := range objs {
+		res = append(res, m.(*harbor_api.Artifact))
+	}
+	return res, nil
+}
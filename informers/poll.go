@@ -0,0 +1,184 @@
+package informers
+
+import (
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListFunc lists all the objects of one kind, and returns a list object such as *harbor_api.ProjectList
+type ListFunc func() (runtime.Object, error)
+
+// Refresh re-lists one scope of the objects between the polls, such as the artifacts of one repository
+type Refresh struct {
+	// Prefix selects the keys of the scope inside the last list
+	Prefix string
+	List   ListFunc
+}
+
+// RefreshFunc sends the scopes to be re-listed until stopCh was closed
+type RefreshFunc func(stopCh <-chan struct{}) <-chan Refresh
+
+// NewPollListWatch returns a cache.ListerWatcher backed by periodic lists. Its watch re-lists every interval,
+// and reports the differences against the previous list as Added, Modified and Deleted events.
+func NewPollListWatch(list ListFunc, interval time.Duration) cache.ListerWatcher {
+	return NewPollListWatchWithRefresh(list, interval, nil)
+}
+
+// NewPollListWatchWithRefresh was the same as NewPollListWatch, and its watch also re-lists the scopes sent by refresh,
+// so that the changes pushed by the image watches were reported before the next poll
+func NewPollListWatchWithRefresh(list ListFunc, interval time.Duration, refresh RefreshFunc) cache.ListerWatcher {
+	return &pollListWatch{
+		list:     list,
+		interval: interval,
+		refresh:  refresh,
+		last:     make(map[string]runtime.Object, 0),
+	}
+}
+
+type pollListWatch struct {
+	list     ListFunc
+	interval time.Duration
+	refresh  RefreshFunc
+
+	mu   sync.Mutex
+	last map[string]runtime.Object
+}
+
+func (lw *pollListWatch) List(options metav1.ListOptions) (runtime.Object, error) {
+	res, err := lw.list()
+	if err != nil {
+		return nil, err
+	}
+	objs, err := byKey(res)
+	if err != nil {
+		return nil, err
+	}
+	lw.mu.Lock()
+	lw.last = objs
+	lw.mu.Unlock()
+	return res, nil
+}
+
+func (lw *pollListWatch) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	ch := make(chan watch.Event)
+	w := watch.NewProxyWatcher(ch)
+	go lw.poll(w, ch)
+	return w, nil
+}
+
+func (lw *pollListWatch) poll(w *watch.ProxyWatcher, ch chan watch.Event) {
+	defer close(ch)
+	tick := time.NewTicker(lw.interval)
+	defer tick.Stop()
+	var refresh <-chan Refresh
+	if lw.refresh != nil {
+		refresh = lw.refresh(w.StopChan())
+	}
+	for {
+		var events []watch.Event
+		select {
+		case <-w.StopChan():
+			return
+		case <-tick.C:
+			res, err := lw.list()
+			if err != nil {
+				zaplogger.Sugar().Error(err)
+				continue
+			}
+			current, err := byKey(res)
+			if err != nil {
+				zaplogger.Sugar().Error(err)
+				continue
+			}
+			// the last list was shared with the following watches, so that a re-watch starts from here
+			lw.mu.Lock()
+			last := lw.last
+			lw.last = current
+			lw.mu.Unlock()
+			events = diff(last, current)
+		case r := <-refresh:
+			res, err := r.List()
+			if err != nil {
+				zaplogger.Sugar().Error(err)
+				continue
+			}
+			current, err := byKey(res)
+			if err != nil {
+				zaplogger.Sugar().Error(err)
+				continue
+			}
+			events = lw.replace(r.Prefix, current)
+		}
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-w.StopChan():
+				return
+			}
+		}
+	}
+}
+
+// replace replaces the objects whose keys start with the prefix inside the last list, and returns their differences
+func (lw *pollListWatch) replace(prefix string, current map[string]runtime.Object) []watch.Event {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	last := make(map[string]runtime.Object)
+	// the last list was copied, since the polls diff the replaced ones outside the lock
+	objs := make(map[string]runtime.Object, len(lw.last))
+	for k, v := range lw.last {
+		if strings.HasPrefix(k, prefix) {
+			last[k] = v
+			continue
+		}
+		objs[k] = v
+	}
+	for k, v := range current {
+		objs[k] = v
+	}
+	lw.last = objs
+	return diff(last, current)
+}
+
+func byKey(list runtime.Object) (map[string]runtime.Object, error) {
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]runtime.Object, len(items))
+	for _, v := range items {
+		key, err := cache.MetaNamespaceKeyFunc(v)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = v
+	}
+	return res, nil
+}
+
+func diff(last, current map[string]runtime.Object) []watch.Event {
+	res := make([]watch.Event, 0)
+	for k, v := range current {
+		old, ok := last[k]
+		switch {
+		case !ok:
+			res = append(res, watch.Event{Type: watch.Added, Object: v})
+		case !equality.Semantic.DeepEqual(old, v):
+			res = append(res, watch.Event{Type: watch.Modified, Object: v})
+		}
+	}
+	for k, v := range last {
+		if _, ok := current[k]; !ok {
+			res = append(res, watch.Event{Type: watch.Deleted, Object: v})
+		}
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+package harbor_api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	"github.com/goharbor/harbor/src/controller/artifact"
+	"net/http"
+	"sort"
+)
+
+// MirrorDigest is the digest resolved from one harbor of a mirror group
+type MirrorDigest struct {
+	Url    string `json:"url"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DigestVerification is the result of VerifyDigest, the harbor itself comes first and then its mirrors
+type DigestVerification struct {
+	Project    string         `json:"project"`
+	Repository string         `json:"repository"`
+	Reference  string         `json:"reference"`
+	Digests    []MirrorDigest `json:"digests"`
+	// Consistent was true once all the harbors resolved the same digest
+	Consistent bool `json:"consistent"`
+}
+
+// healthRank orders the harbors for the failover, the unchecked ones were tried before the degraded ones
+func healthRank(s HealthState) int {
+	switch s {
+	case HealthStateHealthy:
+		return 0
+	case HealthStateDegraded:
+		return 2
+	case HealthStateUnreachable:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// group returns the harbor of the url first, and then its mirrors in the order of the config.
+// The mirrors which were not inside the hub were skipped.
+func (h *hub) group(url string) ([]hubHarbor, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	t, ok := h.harbors[NormalizeHost(url)]
+	if !ok {
+		return nil, fmt.Errorf(ErrorHarborUrlWasNotExisted, url)
+	}
+	res := []hubHarbor{*t}
+	seen := map[*hubHarbor]bool{t: true}
+	for _, m := range t.config.Mirrors {
+		if v, ok := h.harbors[NormalizeHost(m)]; ok && !seen[v] {
+			seen[v] = true
+			res = append(res, *v)
+		}
+	}
+	return res, nil
+}
+
+// instances returns the group of the url ordered by their last health checks and latencies.
+// With preferPrimary the harbor itself stays the first unless it was unreachable, as the mirrors may lag behind.
+func (h *hub) instances(url string, preferPrimary bool) ([]hubHarbor, error) {
+	res, err := h.group(url)
+	if err != nil {
+		return nil, err
+	}
+	sorted := res
+	if preferPrimary && res[0].status.State != HealthStateUnreachable {
+		sorted = res[1:]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, rj := healthRank(sorted[i].status.State), healthRank(sorted[j].status.State)
+		if ri != rj {
+			return ri < rj
+		}
+		return sorted[i].status.Latency < sorted[j].status.Latency
+	})
+	return res, nil
+}
+
+// failover returns true if the error came from the harbor being unavailable, such as a transport error or a 5xx.
+// The other responses such as 404 were the answer of the harbor, and a lagging mirror must not override them.
+func failover(err error) bool {
+	var e *StatusError
+	return !errors.As(err, &e) || e.Code >= http.StatusInternalServerError
+}
+
+func (h *hub) References(url, projectName, repositoryName, digestOrTag string) (artifact.Artifact, error) {
+	return h.references(url, false, projectName, repositoryName, digestOrTag)
+}
+
+func (h *hub) references(url string, preferPrimary bool, projectName, repositoryName, digestOrTag string) (res artifact.Artifact, err error) {
+	instances, err := h.instances(url, preferPrimary)
+	if err != nil {
+		return res, err
+	}
+	for _, t := range instances {
+		if res, err = t.harbor.References(projectName, repositoryName, digestOrTag); err == nil || !failover(err) {
+			return res, err
+		}
+		zaplogger.Sugar().Warnw("harbor references failed, failing over", "url", t.url, "project", projectName, "repository", repositoryName, "reference", digestOrTag, "err", err)
+	}
+	return res, err
+}
+
+func (h *hub) Artifacts(url, projectName, repositoryName string) ([]artifact.Artifact, error) {
+	return h.artifacts(url, false, false, projectName, repositoryName)
+}
+
+// artifacts lists all the pages of the artifacts, or only the first page with firstPage,
+// which the batch polling uses so that each poll stays a single request
+func (h *hub) artifacts(url string, preferPrimary, firstPage bool, projectName, repositoryName string) (res []artifact.Artifact, err error) {
+	instances, err := h.instances(url, preferPrimary)
+	if err != nil {
+		return res, err
+	}
+	for _, t := range instances {
+		list := t.harbor.Artifacts
+		if firstPage {
+			list = t.page
+		}
+		if res, err = list(projectName, repositoryName); err == nil || !failover(err) {
+			return res, err
+		}
+		zaplogger.Sugar().Warnw("harbor artifacts failed, failing over", "url", t.url, "project", projectName, "repository", repositoryName, "err", err)
+	}
+	return res, err
+}
+
+func (h *hub) VerifyDigest(url, projectName, repositoryName, digestOrTag string) (res DigestVerification, err error) {
+	group, err := h.group(url)
+	if err != nil {
+		return res, err
+	}
+	res = DigestVerification{
+		Project:    projectName,
+		Repository: repositoryName,
+		Reference:  digestOrTag,
+		Digests:    make([]MirrorDigest, 0, len(group)),
+		Consistent: true,
+	}
+	for _, v := range group {
+		d := MirrorDigest{Url: v.url}
+		if a, err := v.harbor.References(projectName, repositoryName, digestOrTag); err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Digest = a.Digest
+		}
+		res.Digests = append(res.Digests, d)
+		if d.Error != "" || d.Digest != res.Digests[0].Digest {
+			res.Consistent = false
+		}
+	}
+	return res, nil
+}
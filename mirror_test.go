@@ -0,0 +1,303 @@
+package harbor_api
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	mirrorDigestA = "sha256:27d6aa8f9d040c5e85c61a093ad2dc769e57440e8240c3294f47093e97d96c9a"
+	mirrorDigestB = "sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"
+)
+
+// newMirrorServer serves the artifact app:latest with the digest, and responds 503 once down was set
+func newMirrorServer(digest *atomic.Value, down *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		digest := digest.Load().(string)
+		switch r.URL.Path {
+		case "/api/v2.0/projects/proj/repositories/app/artifacts/latest":
+			_, _ = w.Write([]byte(`{"digest":"` + digest + `","tags":[{"name":"latest"}]}`))
+		case "/api/v2.0/projects/proj/repositories/app/artifacts":
+			_, _ = w.Write([]byte(`[{"digest":"` + digest + `","tags":[{"name":"latest"}]}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func Test_hub_Mirrors(t *testing.T) {
+	var (
+		primaryDigest, mirrorDigest atomic.Value
+		primaryDown, mirrorDown     int32
+	)
+	primaryDigest.Store(mirrorDigestA)
+	mirrorDigest.Store(mirrorDigestA)
+	primary := newMirrorServer(&primaryDigest, &primaryDown)
+	defer primary.Close()
+	mirror := newMirrorServer(&mirrorDigest, &mirrorDown)
+	defer mirror.Close()
+	h := NewHub([]Config{
+		{Url: primary.URL, Mirrors: []string{mirror.URL, "harbor.domain13333.com"}},
+		{Url: mirror.URL},
+	})
+	defer h.Close()
+
+	got, err := h.VerifyDigest(primary.URL, "proj", "app", "latest")
+	if err != nil {
+		t.Fatalf("hub.VerifyDigest() error = %v", err)
+	}
+	if !got.Consistent || len(got.Digests) != 2 || got.Digests[0].Url != primary.URL || got.Digests[1].Digest != mirrorDigestA {
+		t.Errorf("hub.VerifyDigest() = %+v, want consistent digests of the primary and the mirror", got)
+	}
+
+	t1, err := h.Get(primary.URL)
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+	w, err := t1.Watch(Option{Project: "proj", Repository: "app", Tag: "latest", Sha256: mirrorDigestA})
+	if err != nil {
+		t.Fatalf("harbor.Watch() error = %v", err)
+	}
+	defer w.Stop()
+
+	// the primary goes down, the reads and the watch fail over to the mirror which moved to another digest
+	atomic.StoreInt32(&primaryDown, 1)
+	mirrorDigest.Store(mirrorDigestB)
+	a, err := h.References(primary.URL, "proj", "app", "latest")
+	if err != nil || a.Digest != mirrorDigestB {
+		t.Errorf("hub.References() = %v, %v, want %v from the mirror", a.Digest, err, mirrorDigestB)
+	}
+	list, err := h.Artifacts(primary.URL, "proj", "app")
+	if err != nil || len(list) != 1 || list[0].Digest != mirrorDigestB {
+		t.Errorf("hub.Artifacts() = %v, %v, want %v from the mirror", list, err, mirrorDigestB)
+	}
+	if a, err = h.ResolveImage(strings.TrimPrefix(primary.URL, HttpPrefix) + "/proj/app:latest"); err != nil || a.Digest != mirrorDigestB {
+		t.Errorf("hub.ResolveImage() = %v, %v, want %v from the mirror", a.Digest, err, mirrorDigestB)
+	}
+	timeout := time.After(time.Second * 10)
+	for done := false; !done; {
+		select {
+		case e := <-w.ResultChan():
+			if e.Type == watch.Modified {
+				if c := e.Object.(*ImageDigestChange); c.Spec.Sha256 != mirrorDigestB {
+					t.Errorf("the watch sha256 = %v, want %v", c.Spec.Sha256, mirrorDigestB)
+				}
+				done = true
+			}
+		case <-timeout:
+			t.Fatalf("the watch didn't fail over to the mirror")
+		}
+	}
+
+	got, err = h.VerifyDigest(primary.URL, "proj", "app", "latest")
+	if err != nil {
+		t.Fatalf("hub.VerifyDigest() error = %v", err)
+	}
+	if got.Consistent || got.Digests[0].Error == "" || got.Digests[1].Digest != mirrorDigestB {
+		t.Errorf("hub.VerifyDigest() = %+v, want the failed primary", got)
+	}
+
+	atomic.StoreInt32(&mirrorDown, 1)
+	if _, err = h.References(primary.URL, "proj", "app", "latest"); err == nil {
+		t.Errorf("hub.References() succeeded with all the harbors down")
+	}
+	if _, err = h.References("harbor.domain13333.com", "proj", "app", "latest"); err == nil {
+		t.Errorf("hub.References() succeeded with an unknown harbor")
+	}
+}
+
+func Test_hub_Mirrors_NotFound(t *testing.T) {
+	var (
+		digest atomic.Value
+		down   int32
+	)
+	digest.Store(mirrorDigestA)
+	primary := newMirrorServer(&digest, &down)
+	defer primary.Close()
+	// the lagging mirror still serves the tag deleted from the primary
+	lagging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2.0/projects/proj/repositories/app/artifacts/deleted":
+			_, _ = w.Write([]byte(`{"digest":"` + mirrorDigestB + `","tags":[{"name":"deleted"}]}`))
+		case "/api/v2.0/projects/proj/repositories/gone/artifacts":
+			_, _ = w.Write([]byte(`[{"digest":"` + mirrorDigestB + `"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer lagging.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	h := NewHub([]Config{
+		{Url: primary.URL, Mirrors: []string{lagging.URL}},
+		{Url: lagging.URL, Mirrors: []string{closed.URL}},
+		{Url: closed.URL},
+	})
+	defer h.Close()
+
+	if _, err := h.References(primary.URL, "proj", "app", "deleted"); !IsNotFound(err) {
+		t.Errorf("hub.References() error = %v, want the 404 of the primary", err)
+	}
+	if _, err := h.Artifacts(primary.URL, "proj", "gone"); !IsNotFound(err) {
+		t.Errorf("hub.Artifacts() error = %v, want the 404 of the primary", err)
+	}
+	// the 404 was kept instead of the transport error of the mirror which was down
+	if _, err := h.References(lagging.URL, "proj", "app", "missing"); !IsNotFound(err) {
+		t.Errorf("hub.References() error = %v, want the 404 of the harbor", err)
+	}
+	if a, err := h.References(primary.URL, "proj", "app", "latest"); err != nil || a.Digest != mirrorDigestA {
+		t.Errorf("hub.References() = %v, %v, want %v", a.Digest, err, mirrorDigestA)
+	}
+
+	t1, err := h.Get(primary.URL)
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+	w, err := t1.Watch(Option{Project: "proj", Repository: "app", Tag: "deleted", Sha256: mirrorDigestB})
+	if err != nil {
+		t.Fatalf("harbor.Watch() error = %v", err)
+	}
+	defer w.Stop()
+	timeout := time.After(time.Second * 10)
+	for done := false; !done; {
+		select {
+		case e := <-w.ResultChan():
+			if e.Type == watch.Modified {
+				t.Fatalf("the watch followed the lagging mirror: %v", e)
+			}
+			done = e.Type == watch.Deleted
+		case <-timeout:
+			t.Fatalf("the watch didn't report the deleted tag")
+		}
+	}
+}
+
+func Test_hub_instances(t *testing.T) {
+	h := NewHub([]Config{
+		{Url: "primary.domain.com", Mirrors: []string{"https://mirror1.domain.com/", "mirror2.domain.com", "primary.domain.com"}},
+		{Url: "mirror1.domain.com"},
+		{Url: "mirror2.domain.com"},
+	}).(*hub)
+	defer h.Close()
+	setStatus := func(url string, state HealthState, latency time.Duration) {
+		h.harbors[url].status = HarborStatus{State: state, Latency: latency}
+	}
+	urls := func(preferPrimary bool) string {
+		res, err := h.instances("primary.domain.com", preferPrimary)
+		if err != nil {
+			t.Fatalf("hub.instances() error = %v", err)
+		}
+		s := make([]string, 0, len(res))
+		for _, v := range res {
+			s = append(s, NormalizeHost(v.url))
+		}
+		return strings.Join(s, ",")
+	}
+	tests := []struct {
+		name          string
+		status        map[string]HealthState
+		latency       map[string]time.Duration
+		preferPrimary bool
+		want          string
+	}{
+		{
+			name: "Test_hub_instances_unchecked",
+			want: "primary.domain.com,mirror1.domain.com,mirror2.domain.com",
+		},
+		{
+			name:    "Test_hub_instances_nearest",
+			status:  map[string]HealthState{"primary.domain.com": HealthStateHealthy, "mirror1.domain.com": HealthStateHealthy, "mirror2.domain.com": HealthStateHealthy},
+			latency: map[string]time.Duration{"primary.domain.com": time.Millisecond * 30, "mirror1.domain.com": time.Millisecond * 20, "mirror2.domain.com": time.Millisecond * 10},
+			want:    "mirror2.domain.com,mirror1.domain.com,primary.domain.com",
+		},
+		{
+			name:          "Test_hub_instances_preferPrimary",
+			status:        map[string]HealthState{"primary.domain.com": HealthStateDegraded, "mirror1.domain.com": HealthStateHealthy, "mirror2.domain.com": HealthStateHealthy},
+			latency:       map[string]time.Duration{"primary.domain.com": time.Millisecond * 30, "mirror1.domain.com": time.Millisecond * 20, "mirror2.domain.com": time.Millisecond * 10},
+			preferPrimary: true,
+			want:          "primary.domain.com,mirror2.domain.com,mirror1.domain.com",
+		},
+		{
+			name:          "Test_hub_instances_unreachablePrimary",
+			status:        map[string]HealthState{"primary.domain.com": HealthStateUnreachable, "mirror1.domain.com": HealthStateHealthy, "mirror2.domain.com": HealthStateDegraded},
+			preferPrimary: true,
+			want:          "mirror1.domain.com,mirror2.domain.com,primary.domain.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range []string{"primary.domain.com", "mirror1.domain.com", "mirror2.domain.com"} {
+				setStatus(v, tt.status[v], tt.latency[v])
+			}
+			if got := urls(tt.preferPrimary); got != tt.want {
+				t.Errorf("hub.instances() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hub_BatchPolling_FirstPage(t *testing.T) {
+	var listed, paged, referenced int32
+	items := make([]string, 0, 120)
+	for k := 0; k < 120; k++ {
+		items = append(items, fmt.Sprintf(`{"digest":"sha256:%d","tags":[{"name":"tag-%d"}]}`, k, k))
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v2.0/projects/proj/repositories/app/artifacts":
+			atomic.AddInt32(&listed, 1)
+			if r.URL.Query().Get("page") != "1" {
+				atomic.AddInt32(&paged, 1)
+			}
+			writePage(w, r, items)
+		case strings.HasPrefix(r.URL.Path, "/api/v2.0/projects/proj/repositories/app/artifacts/"):
+			atomic.AddInt32(&referenced, 1)
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	h := NewHub([]Config{{Url: s.URL}})
+	defer h.Close()
+	t1, err := h.Get(s.URL)
+	if err != nil {
+		t.Fatalf("hub.Get() error = %v", err)
+	}
+	// both the tags were on the first page, so each batch was a single listing of it
+	for _, v := range []string{"tag-0", "tag-1"} {
+		w, err := t1.Watch(Option{Project: "proj", Repository: "app", Tag: v, Sha256: "sha256:0", Policy: Policy{Interval: time.Millisecond * 100, Jitter: -1}})
+		if err != nil {
+			t.Fatalf("harbor.Watch() error = %v", err)
+		}
+		defer w.Stop()
+	}
+	timeout := time.After(time.Second * 10)
+	for atomic.LoadInt32(&listed) < 3 {
+		select {
+		case <-time.After(time.Millisecond * 10):
+		case <-timeout:
+			t.Fatalf("the watches were not batch polled")
+		}
+	}
+	if n := atomic.LoadInt32(&paged); n != 0 {
+		t.Errorf("the batch polling requested %d pages after the first one, want 0", n)
+	}
+	if n := atomic.LoadInt32(&referenced); n != 0 {
+		t.Errorf("the batch polling requested %d artifacts one by one, want 0", n)
+	}
+	// the hub itself still lists all the pages
+	if list, err := h.Artifacts(s.URL, "proj", "app"); err != nil || len(list) != 120 {
+		t.Errorf("hub.Artifacts() = %d artifacts, error = %v, want 120", len(list), err)
+	}
+}
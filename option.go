@@ -3,39 +3,44 @@ package harbor_api
 import (
 	"fmt"
 
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Option describes the watched image, the watches send ImageDigestChange instead of Option itself
 type Option struct {
-	APIVersion string
-	Kind       string
-
-	Project     string
-	Repository  string
-	Tag         string
-	Sha256      string
-	ExpiredTime int64
+	metav1.TypeMeta `json:",inline"`
+
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	// Sha256 is the digest the caller has seen last, Watch reports a watch.Modified
+	// on the first poll if harbor differs from it, instead of silently adopting the polled one
+	Sha256 string `json:"sha256,omitempty"`
+	// ExpiredTime is the unix timestamp in seconds after which the watch expires, zero never expires
+	ExpiredTime int64 `json:"expiredTime,omitempty"`
+	// SendInitialEvents asks Watch to send a synthetic watch.Added with the current digest first.
+	// Sha256 still takes precedence: if the image was known to differ from it, the first event was
+	// a watch.Modified from Sha256 instead, and an unresolved image starts from Sha256 like WatchFrom.
+	SendInitialEvents bool `json:"sendInitialEvents,omitempty"`
+	// Platform selects a manifest of the image index such as linux/arm64, see ParsePlatform.
+	// The watch reports the digest of the platform manifest, so that it fires only once that platform was rebuilt.
+	Platform string `json:"platform,omitempty"`
+
+	Policy Policy `json:"policy,omitempty"`
 }
 
+// ImageName returns the name of the watch, the platform was appended after "#" such as p/app:latest#linux/arm64
 func (o Option) ImageName() string {
+	if o.Platform != "" {
+		return fmt.Sprintf("%s/%s:%s#%s", o.Project, o.Repository, o.Tag, o.Platform)
+	}
 	return fmt.Sprintf("%s/%s:%s", o.Project, o.Repository, o.Tag)
 }
 
-func (o Option) GetObjectKind() schema.ObjectKind {
-	return o
-}
-
-func (o Option) DeepCopyObject() runtime.Object {
-	a := o
-	return a
-}
-
-func (o Option) SetGroupVersionKind(kind schema.GroupVersionKind) {
-	o.APIVersion = kind.Version
-	o.Kind = kind.Kind
-}
-
-func (o Option) GroupVersionKind() schema.GroupVersionKind {
-	return schema.FromAPIVersionAndKind(o.APIVersion, o.Kind)
+// RepositoryName returns the full repository name which contains the project
+func (o Option) RepositoryName() string {
+	return fmt.Sprintf("%s/%s", o.Project, o.Repository)
 }
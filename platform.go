@@ -0,0 +1,114 @@
+package harbor_api
+
+import (
+	"fmt"
+	"github.com/goharbor/harbor/src/controller/artifact"
+	"strings"
+)
+
+const (
+	ErrorInvalidPlatform  = "error: invalid platform:%s, it should be os/architecture[/variant]"
+	ErrorPlatformNotFound = "error: the image index:%s has no manifest of the platform:%s"
+)
+
+// Platform selects a manifest inside an image index, such as linux/arm64/v8
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// PlatformManifest is the manifest of one platform inside an image index
+type PlatformManifest struct {
+	Platform Platform `json:"platform"`
+	Digest   string   `json:"digest"`
+}
+
+// ParsePlatform parses os/architecture[/variant] such as linux/amd64 or linux/arm/v7
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, fmt.Errorf(ErrorInvalidPlatform, s)
+	}
+	for _, v := range parts {
+		if v == "" {
+			return Platform{}, fmt.Errorf(ErrorInvalidPlatform, s)
+		}
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
+
+// normalizedVariant treats arm64 without a variant as arm64/v8, which was the only variant of it
+func (p Platform) normalizedVariant() string {
+	if p.Architecture == "arm64" && p.Variant == "" {
+		return "v8"
+	}
+	return p.Variant
+}
+
+// Match returns true if the platform was selected by p, an empty variant of p matches any variant
+func (p Platform) Match(o Platform) bool {
+	if !strings.EqualFold(p.OS, o.OS) || !strings.EqualFold(p.Architecture, o.Architecture) {
+		return false
+	}
+	return p.Variant == "" || strings.EqualFold(p.normalizedVariant(), o.normalizedVariant())
+}
+
+// attrString reads a string from the extra attributes of an artifact
+func attrString(attrs map[string]interface{}, key string) string {
+	if v, ok := attrs[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// ArtifactPlatforms returns the platform manifests of an image index from its references. An artifact which was not an
+// index returns itself, whose platform was read from the extra attributes of its config.
+func ArtifactPlatforms(a artifact.Artifact) []PlatformManifest {
+	res := make([]PlatformManifest, 0, len(a.References))
+	for _, ref := range a.References {
+		if ref == nil || ref.Platform == nil {
+			continue
+		}
+		res = append(res, PlatformManifest{
+			Platform: Platform{OS: ref.Platform.OS, Architecture: ref.Platform.Architecture, Variant: ref.Platform.Variant},
+			Digest:   ref.ChildDigest,
+		})
+	}
+	if len(a.References) == 0 {
+		res = append(res, PlatformManifest{
+			Platform: Platform{
+				OS:           attrString(a.ExtraAttrs, "os"),
+				Architecture: attrString(a.ExtraAttrs, "architecture"),
+				Variant:      attrString(a.ExtraAttrs, "variant"),
+			},
+			Digest: a.Digest,
+		})
+	}
+	return res
+}
+
+// PlatformDigest returns the digest of the platform manifest selected by p. The digest of an artifact
+// which was not an index was returned as it was, since harbor may not know the platform of its config.
+func PlatformDigest(a artifact.Artifact, p Platform) (string, error) {
+	if len(a.References) == 0 {
+		return a.Digest, nil
+	}
+	for _, v := range ArtifactPlatforms(a) {
+		if p.Match(v.Platform) {
+			return v.Digest, nil
+		}
+	}
+	return "", fmt.Errorf(ErrorPlatformNotFound, a.Digest, p)
+}
@@ -0,0 +1,245 @@
+package harbor_api
+
+import (
+	"context"
+	"fmt"
+	"github.com/goharbor/harbor/src/controller/artifact"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newIndexArtifact decodes an image index whose references were the digests keyed by the platforms
+func newIndexArtifact(t *testing.T, digest string, platforms map[string]string) artifact.Artifact {
+	refs := make([]string, 0)
+	for k, v := range platforms {
+		p, err := ParsePlatform(k)
+		if err != nil {
+			t.Fatalf("ParsePlatform() error = %v", err)
+		}
+		refs = append(refs, fmt.Sprintf(`{"child_digest":%q,"platform":{"os":%q,"architecture":%q,"variant":%q}}`, v, p.OS, p.Architecture, p.Variant))
+	}
+	a := artifact.Artifact{}
+	cont := fmt.Sprintf(`{"digest":%q,"media_type":%q,"references":[`, digest, MediaTypeOCIIndex)
+	for n, v := range refs {
+		if n > 0 {
+			cont += ","
+		}
+		cont += v
+	}
+	if err := json.Unmarshal([]byte(cont+"]}"), &a); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	return a
+}
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Platform
+		wantErr bool
+	}{
+		{name: "TestParsePlatform_os_arch", in: "linux/amd64", want: Platform{OS: "linux", Architecture: "amd64"}},
+		{name: "TestParsePlatform_variant", in: "Linux/ARM/v7", want: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{name: "TestParsePlatform_os_only", in: "linux", wantErr: true},
+		{name: "TestParsePlatform_empty_part", in: "linux//v7", wantErr: true},
+		{name: "TestParsePlatform_too_many", in: "linux/arm/v7/x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePlatform(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePlatform() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlatform_Match(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Platform
+		o    Platform
+		want bool
+	}{
+		{name: "TestPlatform_Match_same", p: Platform{OS: "linux", Architecture: "amd64"}, o: Platform{OS: "linux", Architecture: "amd64"}, want: true},
+		{name: "TestPlatform_Match_any_variant", p: Platform{OS: "linux", Architecture: "arm"}, o: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, want: true},
+		{name: "TestPlatform_Match_variant", p: Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, o: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, want: false},
+		{name: "TestPlatform_Match_arm64_v8", p: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, o: Platform{OS: "linux", Architecture: "arm64"}, want: true},
+		{name: "TestPlatform_Match_arch", p: Platform{OS: "linux", Architecture: "amd64"}, o: Platform{OS: "linux", Architecture: "arm64"}, want: false},
+		{name: "TestPlatform_Match_os", p: Platform{OS: "windows", Architecture: "amd64"}, o: Platform{OS: "linux", Architecture: "amd64"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.Match(tt.o); got != tt.want {
+				t.Errorf("Platform.Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlatformDigest(t *testing.T) {
+	index := newIndexArtifact(t, "sha256:index", map[string]string{"linux/amd64": "sha256:amd64", "linux/arm64/v8": "sha256:arm64"})
+	single := artifact.Artifact{}
+	single.Digest = "sha256:single"
+	tests := []struct {
+		name     string
+		a        artifact.Artifact
+		platform string
+		want     string
+		wantErr  bool
+	}{
+		{name: "TestPlatformDigest_amd64", a: index, platform: "linux/amd64", want: "sha256:amd64"},
+		{name: "TestPlatformDigest_arm64", a: index, platform: "linux/arm64", want: "sha256:arm64"},
+		{name: "TestPlatformDigest_missing", a: index, platform: "linux/s390x", wantErr: true},
+		{name: "TestPlatformDigest_single", a: single, platform: "linux/s390x", want: "sha256:single"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := ParsePlatform(tt.platform)
+			got, err := PlatformDigest(tt.a, p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PlatformDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("PlatformDigest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImages_Platform(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current = map[string]string{"linux/amd64": "sha256:amd64-1", "linux/arm64": "sha256:arm64-1"}
+		index   = "sha256:index-1"
+	)
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return newIndexArtifact(t, index, current), nil
+	}
+	digest := func(projectName string, repositoryName string, tag string, etag string) (string, string, error) {
+		t.Errorf("the DigestHandler was called for the platform")
+		return "", "", nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy:        Policy{Interval: time.Second, Jitter: -1},
+		Clock:         fc,
+		DigestHandler: digest,
+	})
+	if _, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest", Platform: "linux"}); err == nil {
+		t.Errorf("Images.Image() accepted an invalid platform")
+	}
+	i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest", Platform: "Linux/ARM64"})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := i.WatchWithInitialEvents()
+	defer w.Stop()
+	next := func() watch.Event {
+		select {
+		case e := <-w.ResultChan():
+			return e
+		case <-time.After(time.Millisecond * 50):
+			return watch.Event{}
+		}
+	}
+	step := func(platform, d string) {
+		mu.Lock()
+		if platform != "" {
+			current[platform] = d
+		}
+		index = fmt.Sprintf("sha256:index-%d", time.Now().UnixNano())
+		mu.Unlock()
+		waitQueued(imgs)
+		fc.Step(time.Second)
+		waitQueued(imgs)
+	}
+
+	step("", "")
+	if e := next(); e.Type != watch.Added || e.Object.(*ImageDigestChange).Spec.Sha256 != "sha256:arm64-1" || e.Object.(*ImageDigestChange).Spec.Platform != "linux/arm64" {
+		t.Errorf("event = %v, want Added with sha256:arm64-1", e)
+	}
+	// the index moved for the other platform only
+	step("linux/amd64", "sha256:amd64-2")
+	if e := next(); e.Type != "" {
+		t.Errorf("event = %v, want none for the other platform", e)
+	}
+	step("linux/arm64", "sha256:arm64-2")
+	e := next()
+	if e.Type != watch.Modified {
+		t.Fatalf("event = %v, want Modified", e)
+	}
+	if got, want := e.Object.(*ImageDigestChange).Spec, (ImageDigestChangeSpec{Project: "p", Repository: "r", Tag: "latest", Sha256: "sha256:arm64-2", PreviousSha256: "sha256:arm64-1", Platform: "linux/arm64"}); got != want {
+		t.Errorf("event spec = %+v, want %+v", got, want)
+	}
+	if status := imgs.ListWatches(); len(status) != 1 || status[0].Name != "p/r:latest#linux/arm64" {
+		t.Errorf("Images.ListWatches() = %+v", status)
+	}
+}
+
+func Test_harbor_Platforms(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v2.0/projects/proj/repositories/app/artifacts/latest":
+			_, _ = w.Write([]byte(`{"digest":"sha256:index","references":[{"child_digest":"sha256:amd64","platform":{"os":"linux","architecture":"amd64"}},{"child_digest":"sha256:armv7","platform":{"os":"linux","architecture":"arm","variant":"v7"}}]}`))
+		case "/api/v2.0/projects/proj/repositories/app/artifacts/single":
+			_, _ = w.Write([]byte(`{"digest":"sha256:single","extra_attrs":{"os":"linux","architecture":"amd64"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	h := NewHarbor(s.URL, "admin", "pwd")
+	defer h.Close(context.Background())
+	tests := []struct {
+		name    string
+		ref     string
+		want    []PlatformManifest
+		wantErr bool
+	}{
+		{
+			name: "Test_harbor_Platforms_index",
+			ref:  "latest",
+			want: []PlatformManifest{
+				{Platform: Platform{OS: "linux", Architecture: "amd64"}, Digest: "sha256:amd64"},
+				{Platform: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, Digest: "sha256:armv7"},
+			},
+		},
+		{
+			name: "Test_harbor_Platforms_single",
+			ref:  "single",
+			want: []PlatformManifest{{Platform: Platform{OS: "linux", Architecture: "amd64"}, Digest: "sha256:single"}},
+		},
+		{
+			name:    "Test_harbor_Platforms_missing",
+			ref:     "missing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.Platforms("proj", "app", tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("harbor.Platforms() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("harbor.Platforms() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
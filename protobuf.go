@@ -0,0 +1,197 @@
+package harbor_api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ErrorProtobufWireType = "error: unsupported protobuf wire type:%d of field:%d"
+)
+
+// The protobuf marshalers of the objects sent by the watches, so that they were encoded by the protobuf
+// serializer of Codecs like the objects of Kubernetes. The wire format was the same as the messages
+//
+//	message ImageDigestChange {
+//	  optional k8s.io.apimachinery.pkg.apis.meta.v1.ObjectMeta metadata = 1;
+//	  optional ImageDigestChangeSpec spec = 2;
+//	}
+//
+//	message ImageDigestChangeSpec {
+//	  optional string project = 1;
+//	  optional string repository = 2;
+//	  optional string tag = 3;
+//	  optional string sha256 = 4;
+//	  optional string previousSha256 = 5;
+//	  optional string platform = 6;
+//	}
+//
+// The TypeMeta was not a field, the serializer carries it inside runtime.Unknown.
+
+func (m *ImageDigestChange) Reset() { *m = ImageDigestChange{} }
+
+func (*ImageDigestChange) ProtoMessage() {}
+
+func (m *ImageDigestChange) String() string {
+	return fmt.Sprintf("%+v", *m)
+}
+
+func (m *ImageDigestChange) Marshal() ([]byte, error) {
+	meta, err := m.ObjectMeta.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	spec, err := m.Spec.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(meta)+len(spec)+2*(1+binary.MaxVarintLen64))
+	b = appendProtoBytes(b, 1, meta)
+	b = appendProtoBytes(b, 2, spec)
+	return b, nil
+}
+
+// Size, MarshalTo, MarshalToSizedBuffer and the XXX methods shadow the ones promoted from the embedded ObjectMeta,
+// which the serializers and gogo/protobuf prefer to Marshal and Unmarshal, and which only encode the metadata
+func (m *ImageDigestChange) Size() int {
+	b, _ := m.Marshal()
+	return len(b)
+}
+
+func (m *ImageDigestChange) MarshalTo(data []byte) (int, error) {
+	b, err := m.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(data, b), nil
+}
+
+func (m *ImageDigestChange) MarshalToSizedBuffer(data []byte) (int, error) {
+	b, err := m.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(data[len(data)-len(b):], b), nil
+}
+
+func (m *ImageDigestChange) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	data, err := m.Marshal()
+	return append(b, data...), err
+}
+
+func (m *ImageDigestChange) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+
+func (m *ImageDigestChange) XXX_Size() int {
+	return m.Size()
+}
+
+func (m *ImageDigestChange) Unmarshal(data []byte) error {
+	return unmarshalProtoFields(data, func(field int, v []byte) error {
+		switch field {
+		case 1:
+			return m.ObjectMeta.Unmarshal(v)
+		case 2:
+			return m.Spec.Unmarshal(v)
+		}
+		return nil
+	})
+}
+
+func (m *ImageDigestChangeSpec) Reset() { *m = ImageDigestChangeSpec{} }
+
+func (*ImageDigestChangeSpec) ProtoMessage() {}
+
+func (m *ImageDigestChangeSpec) String() string {
+	return fmt.Sprintf("%+v", *m)
+}
+
+func (m *ImageDigestChangeSpec) Marshal() ([]byte, error) {
+	b := make([]byte, 0)
+	for k, v := range []string{m.Project, m.Repository, m.Tag, m.Sha256, m.PreviousSha256, m.Platform} {
+		b = appendProtoBytes(b, k+1, []byte(v))
+	}
+	return b, nil
+}
+
+func (m *ImageDigestChangeSpec) Unmarshal(data []byte) error {
+	return unmarshalProtoFields(data, func(field int, v []byte) error {
+		switch field {
+		case 1:
+			m.Project = string(v)
+		case 2:
+			m.Repository = string(v)
+		case 3:
+			m.Tag = string(v)
+		case 4:
+			m.Sha256 = string(v)
+		case 5:
+			m.PreviousSha256 = string(v)
+		case 6:
+			m.Platform = string(v)
+		}
+		return nil
+	})
+}
+
+// appendProtoBytes appends a length-delimited field, the empty ones were kept like the generated marshalers of Kubernetes
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoVarint(b, uint64(field)<<3|2)
+	b = appendProtoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// unmarshalProtoFields passes each length-delimited field to f, and skips the fields of the other wire types
+func unmarshalProtoFields(data []byte, f func(field int, v []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		field, wire := int(key>>3), key&7
+		switch wire {
+		case 0:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[n:]
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[size:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return io.ErrUnexpectedEOF
+			}
+			v := data[n : n+int(l)]
+			data = data[n+int(l):]
+			if err := f(field, v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf(ErrorProtobufWireType, wire, field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package harbor_api
+
+// imageQueue implements heap.Interface, the image with the earliest next poll time comes first
+type imageQueue []*image
+
+func (q imageQueue) Len() int {
+	return len(q)
+}
+
+func (q imageQueue) Less(i, j int) bool {
+	return q[i].next.Before(q[j].next)
+}
+
+func (q imageQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *imageQueue) Push(x interface{}) {
+	i := x.(*image)
+	i.index = len(*q)
+	*q = append(*q, i)
+}
+
+func (q *imageQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	i := old[n-1]
+	old[n-1] = nil
+	i.index = -1
+	*q = old[:n-1]
+	return i
+}
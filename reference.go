@@ -0,0 +1,125 @@
+package harbor_api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ErrorInvalidReference = "error: invalid image reference:%s"
+
+	DefaultTag = "latest"
+)
+
+var (
+	// referencePrefixes were the schemes of the imageID in the pod's container status
+	referencePrefixes = []string{"docker-pullable://", "docker://"}
+
+	hostRegexp      = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp    = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+)
+
+// Reference is a parsed image reference, such as harbor.domain.com:8443/proj/team/app:1.2@sha256:xxx
+type Reference struct {
+	// Host is the registry host with the optional port, it was empty if the reference has no registry
+	Host string
+	// Project is the first component of the path
+	Project string
+	// Repository is the rest of the path, which may be nested such as team/app
+	Repository string
+	// Tag was DefaultTag if neither a tag nor a digest was given
+	Tag    string
+	Digest string
+}
+
+// ParseReference parses an image, or the imageID of a pod's container status with the docker-pullable:// prefix
+func ParseReference(s string) (Reference, error) {
+	res := Reference{}
+	in := s
+	for _, prefix := range referencePrefixes {
+		in = strings.TrimPrefix(in, prefix)
+	}
+	if i := strings.Index(in, "@"); i >= 0 {
+		in, res.Digest = in[:i], in[i+1:]
+		if !digestRegexp.MatchString(res.Digest) {
+			return Reference{}, fmt.Errorf(ErrorInvalidReference, s)
+		}
+	}
+	if i, j := strings.LastIndex(in, ":"), strings.LastIndex(in, "/"); i > j {
+		in, res.Tag = in[:i], in[i+1:]
+		if !tagRegexp.MatchString(res.Tag) {
+			return Reference{}, fmt.Errorf(ErrorInvalidReference, s)
+		}
+	}
+	components := strings.Split(in, "/")
+	if len(components) > 1 && (strings.ContainsAny(components[0], ".:") || components[0] == "localhost") {
+		res.Host, components = components[0], components[1:]
+		if !hostRegexp.MatchString(res.Host) {
+			return Reference{}, fmt.Errorf(ErrorInvalidReference, s)
+		}
+	}
+	if len(components) < 2 {
+		return Reference{}, fmt.Errorf(ErrorInvalidReference, s)
+	}
+	for _, v := range components {
+		if !componentRegexp.MatchString(v) {
+			return Reference{}, fmt.Errorf(ErrorInvalidReference, s)
+		}
+	}
+	res.Project, res.Repository = components[0], strings.Join(components[1:], "/")
+	if res.Tag == "" && res.Digest == "" {
+		res.Tag = DefaultTag
+	}
+	return res, nil
+}
+
+// ParseImage parses the image, and returns the Option to watch it and the url of its harbor
+func ParseImage(s string) (opt Option, url string, err error) {
+	ref, err := ParseReference(s)
+	if err != nil {
+		return Option{}, "", err
+	}
+	return ref.Option(), ref.Url(), nil
+}
+
+// String formats the reference back, ParseReference(r.String()) returns r itself
+func (r Reference) String() string {
+	var b strings.Builder
+	if r.Host != "" {
+		b.WriteString(r.Host)
+		b.WriteString("/")
+	}
+	b.WriteString(r.Project)
+	b.WriteString("/")
+	b.WriteString(r.Repository)
+	if r.Tag != "" {
+		b.WriteString(":")
+		b.WriteString(r.Tag)
+	}
+	if r.Digest != "" {
+		b.WriteString("@")
+		b.WriteString(r.Digest)
+	}
+	return b.String()
+}
+
+// Option returns the Option to watch the tag, the digest becomes Option.Sha256
+func (r Reference) Option() Option {
+	return Option{
+		Project:    r.Project,
+		Repository: r.Repository,
+		Tag:        r.Tag,
+		Sha256:     r.Digest,
+	}
+}
+
+// Url returns the harbor url of the registry host, it was empty without a host
+func (r Reference) Url() string {
+	if r.Host == "" {
+		return ""
+	}
+	return HttpsPrefix + r.Host
+}
@@ -0,0 +1,121 @@
+package harbor_api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:27d6aa8f9d040c5e85c61a093ad2dc769e57440e8240c3294f47093e97d96c9a"
+	tests := []struct {
+		name    string
+		s       string
+		want    Reference
+		wantErr bool
+	}{
+		{
+			name: "TestParseReference_Tag",
+			s:    "harbor.domain.com/helix-saga/go-all:v1.2",
+			want: Reference{Host: "harbor.domain.com", Project: "helix-saga", Repository: "go-all", Tag: "v1.2"},
+		},
+		{
+			name: "TestParseReference_DefaultTag",
+			s:    "harbor.domain.com/helix-saga/go-all",
+			want: Reference{Host: "harbor.domain.com", Project: "helix-saga", Repository: "go-all", Tag: DefaultTag},
+		},
+		{
+			name: "TestParseReference_Port",
+			s:    "harbor.domain.com:8443/proj/app:1.2",
+			want: Reference{Host: "harbor.domain.com:8443", Project: "proj", Repository: "app", Tag: "1.2"},
+		},
+		{
+			name: "TestParseReference_Nested",
+			s:    "harbor.domain.com:8443/proj/team/sub/app:1.2",
+			want: Reference{Host: "harbor.domain.com:8443", Project: "proj", Repository: "team/sub/app", Tag: "1.2"},
+		},
+		{
+			name: "TestParseReference_Localhost",
+			s:    "localhost/proj/app",
+			want: Reference{Host: "localhost", Project: "proj", Repository: "app", Tag: DefaultTag},
+		},
+		{
+			name: "TestParseReference_WithoutHost",
+			s:    "library/nginx:1.19",
+			want: Reference{Project: "library", Repository: "nginx", Tag: "1.19"},
+		},
+		{
+			name: "TestParseReference_Digest",
+			s:    "harbor.domain.com/helix-saga/go-all@" + digest,
+			want: Reference{Host: "harbor.domain.com", Project: "helix-saga", Repository: "go-all", Digest: digest},
+		},
+		{
+			name: "TestParseReference_TagAndDigest",
+			s:    "harbor.domain.com/proj/team/app:1.2@" + digest,
+			want: Reference{Host: "harbor.domain.com", Project: "proj", Repository: "team/app", Tag: "1.2", Digest: digest},
+		},
+		{
+			name: "TestParseReference_DockerPullable",
+			s:    "docker-pullable://harbor.domain.com/helix-saga/go-all@" + digest,
+			want: Reference{Host: "harbor.domain.com", Project: "helix-saga", Repository: "go-all", Digest: digest},
+		},
+		{
+			name:    "TestParseReference_ImageID",
+			s:       "docker://" + digest,
+			wantErr: true,
+		},
+		{
+			name:    "TestParseReference_WithoutProject",
+			s:       "harbor.domain.com/go-all:latest",
+			wantErr: true,
+		},
+		{
+			name:    "TestParseReference_Uppercase",
+			s:       "harbor.domain.com/proj/App:latest",
+			wantErr: true,
+		},
+		{
+			name:    "TestParseReference_InvalidDigest",
+			s:       "harbor.domain.com/proj/app@sha256:xyz",
+			wantErr: true,
+		},
+		{
+			name:    "TestParseReference_EmptyComponent",
+			s:       "harbor.domain.com/proj//app",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReference(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseReference() got = %#v, want %#v", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			again, err := ParseReference(got.String())
+			if err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("ParseReference(%v) = %#v, %v, want round-trip %#v", got.String(), again, err, got)
+			}
+		})
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	opt, url, err := ParseImage("harbor.domain.com:8443/proj/team/app:1.2")
+	if err != nil {
+		t.Fatalf("ParseImage() error = %v", err)
+	}
+	if want := (Option{Project: "proj", Repository: "team/app", Tag: "1.2"}); !reflect.DeepEqual(opt, want) {
+		t.Errorf("ParseImage() opt = %v, want %v", opt, want)
+	}
+	if url != "https://harbor.domain.com:8443" {
+		t.Errorf("ParseImage() url = %v, want https://harbor.domain.com:8443", url)
+	}
+	if opt.ImageName() != "proj/team/app:1.2" {
+		t.Errorf("Option.ImageName() = %v", opt.ImageName())
+	}
+}
@@ -0,0 +1,438 @@
+package harbor_api
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	"io"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorUnsupportedChallenge  = "error: the registry responded with an unsupported challenge:%s"
+	ErrorDigestMismatch        = "error: the registry sent the digest:%s, but the content was %s"
+	ErrorManifestWithoutDigest = "error: the registry sent no digest of the manifest:%s:%s"
+
+	// the media types of the manifests, sent in the Accept header of the manifest requests
+	MediaTypeOCIIndex              = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest           = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerManifestList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest        = "application/vnd.docker.distribution.manifest.v2+json"
+	HeaderDockerContentDigest      = "Docker-Content-Digest"
+	registryPageSize               = 100
+	defaultRegistryTokenExpiration = time.Second * 60
+)
+
+var (
+	// manifestMediaTypes were accepted by the manifest requests, the indexes first
+	manifestMediaTypes = []string{MediaTypeOCIIndex, MediaTypeDockerManifestList, MediaTypeOCIManifest, MediaTypeDockerManifest}
+
+	challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+type RegistryUrlSuffix string
+
+const (
+	Catalog       RegistryUrlSuffix = "v2/_catalog?n=%d"
+	TagsList      RegistryUrlSuffix = "v2/%s/tags/list?n=%d"
+	ManifestsPath RegistryUrlSuffix = "v2/%s/manifests/%s"
+	BlobsPath     RegistryUrlSuffix = "v2/%s/blobs/%s"
+	UploadsPath   RegistryUrlSuffix = "v2/%s/blobs/uploads/"
+)
+
+// RegistryInterface speaks the OCI distribution api (registry v2) of harbor, the repository was the full name
+// including the project such as proj/team/app, and the reference was a tag or a digest
+type RegistryInterface interface {
+	// Catalog lists all the repositories which the credentials can access
+	Catalog(ctx context.Context) ([]string, error)
+	// Tags lists the tags of the repository
+	Tags(ctx context.Context, repository string) ([]string, error)
+	// Manifest gets the manifest or the index, its digest was verified if the registry sent one
+	Manifest(ctx context.Context, repository, reference string) (*Manifest, error)
+	// HeadManifest returns the descriptor of the manifest without downloading it
+	HeadManifest(ctx context.Context, repository, reference string) (Descriptor, error)
+	// CheckManifest sends a manifest HEAD with the etag as If-None-Match, the registry responds 304 if it was not modified
+	CheckManifest(ctx context.Context, repository, reference, etag string) (ManifestCheck, error)
+	// HeadBlob returns the descriptor of the blob without downloading it
+	HeadBlob(ctx context.Context, repository, digest string) (Descriptor, error)
+	// Blob downloads the blob, the caller must close the body
+	Blob(ctx context.Context, repository, digest string) (io.ReadCloser, error)
+	// PushBlob uploads the blob in a single request, the blob which already existed was skipped
+	PushBlob(ctx context.Context, repository string, content []byte) (Descriptor, error)
+	// PushBlobChunked uploads the blob from the reader in the chunks of chunkSize bytes
+	PushBlobChunked(ctx context.Context, repository string, r io.Reader, chunkSize int) (Descriptor, error)
+	// MountBlob mounts the blob of another repository without uploading it, it returns false
+	// if the registry refused to mount it, then the blob should be uploaded instead
+	MountBlob(ctx context.Context, repository, fromRepository, digest string) (bool, error)
+	// PushManifest puts the manifest by the tag or the digest, the blobs it refers to must have been pushed first
+	PushManifest(ctx context.Context, repository, reference, mediaType string, content []byte) (Descriptor, error)
+	// Tag puts the manifest of the reference under the tag
+	Tag(ctx context.Context, repository, reference, tag string) (Descriptor, error)
+}
+
+// Descriptor describes the content of a manifest or a blob
+type Descriptor struct {
+	MediaType string `json:"mediaType,omitempty"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Manifest is an image manifest or an image index, Content was the raw body from which the digest was computed
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        *Descriptor  `json:"config,omitempty"`
+	Layers        []Descriptor `json:"layers,omitempty"`
+	// Manifests were the platform manifests of an index
+	Manifests []Descriptor `json:"manifests,omitempty"`
+
+	Descriptor Descriptor `json:"-"`
+	Content    []byte     `json:"-"`
+}
+
+// ManifestCheck is the result of CheckManifest, the descriptor was empty once NotModified was true
+type ManifestCheck struct {
+	Descriptor  Descriptor
+	ETag        string
+	NotModified bool
+}
+
+// IsIndex returns true for an OCI image index or a docker manifest list
+func (m *Manifest) IsIndex() bool {
+	return m.Descriptor.MediaType == MediaTypeOCIIndex || m.Descriptor.MediaType == MediaTypeDockerManifestList
+}
+
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+type registry struct {
+	url         string
+	credentials func() (admin, password string)
+	timeout     time.Duration
+	client      *http.Client
+
+	mu sync.Mutex
+	// tokens were keyed by the scopes they were requested for
+	tokens map[string]registryToken
+}
+
+// NewRegistry creates the registry client of the harbor url, the bearer tokens were requested with the credentials
+func NewRegistry(url, admin, password string) RegistryInterface {
+	return newRegistry(url, func() (string, string) {
+		return admin, password
+	})
+}
+
+func newRegistry(url string, credentials func() (admin, password string)) *registry {
+	return &registry{
+		url:         strings.TrimRight(url, "/"),
+		credentials: credentials,
+		timeout:     time.Second * 10,
+		// the blobs were streamed to the callers, so that the timeout was applied by the context of each call instead
+		client: &http.Client{},
+		tokens: make(map[string]registryToken, 0),
+	}
+}
+
+// repositoryScope returns the token scope of the repository, such as repository:proj/app:pull
+func repositoryScope(repository string, actions ...string) string {
+	if len(actions) == 0 {
+		actions = []string{"pull"}
+	}
+	return fmt.Sprintf("repository:%s:%s", repository, strings.Join(actions, ","))
+}
+
+// do sends the request with the cached token of the scopes. Once the registry responds 401 with
+// a Bearer challenge, it requests a new token from the realm with the credentials and retries once.
+func (r *registry) do(req *http.Request, scopes ...string) (*http.Response, error) {
+	zaplogger.Sugar().Debugw("harbor-api registry http", "method", req.Method, "url", req.URL.String())
+	key := strings.Join(scopes, " ")
+	r.mu.Lock()
+	t, ok := r.tokens[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(t.expires) {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		zaplogger.Sugar().Error(err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	switch strings.ToLower(strings.SplitN(challenge, " ", 2)[0]) {
+	case "bearer":
+		token, err := r.token(req.Context(), challenge, scopes)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.tokens[key] = token
+		r.mu.Unlock()
+		retry.Header.Set("Authorization", "Bearer "+token.token)
+	case "basic":
+		retry.SetBasicAuth(r.credentials())
+	default:
+		return nil, fmt.Errorf(ErrorUnsupportedChallenge, challenge)
+	}
+	if resp, err = r.client.Do(retry); err != nil {
+		zaplogger.Sugar().Error(err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// token requests a bearer token from the realm of the challenge, the scope of the challenge was used
+// if the request didn't specify any
+func (r *registry) token(ctx context.Context, challenge string, scopes []string) (res registryToken, err error) {
+	params := make(map[string]string)
+	for _, m := range challengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return res, fmt.Errorf(ErrorUnsupportedChallenge, challenge)
+	}
+	q := u.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if len(scopes) == 0 && params["scope"] != "" {
+		scopes = strings.Split(params["scope"], " ")
+	}
+	for _, v := range scopes {
+		q.Add("scope", v)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return res, err
+	}
+	if admin, password := r.credentials(); admin != "" {
+		req.SetBasicAuth(admin, password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		zaplogger.Sugar().Error(err)
+		return res, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return res, NewStatusError(resp)
+	}
+	defer resp.Body.Close()
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	cont, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return res, err
+	}
+	if err = json.Unmarshal(cont, &body); err != nil {
+		return res, err
+	}
+	res.token = body.Token
+	if res.token == "" {
+		res.token = body.AccessToken
+	}
+	expiration := defaultRegistryTokenExpiration
+	if body.ExpiresIn > 0 {
+		expiration = time.Second * time.Duration(body.ExpiresIn)
+	}
+	// the token was renewed a little earlier than it expires
+	res.expires = time.Now().Add(expiration * 9 / 10)
+	return res, nil
+}
+
+// request sends a request without a body, a non-2xx response returns a StatusError
+func (r *registry) request(ctx context.Context, method, u string, accept []string, scopes ...string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	resp, err := r.do(req, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, NewStatusError(resp)
+	}
+	return resp, nil
+}
+
+// list follows the Link headers of the paginated catalog and tags list, and collects the field of each page
+func (r *registry) list(ctx context.Context, u string, field string, scopes ...string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	res := make([]string, 0)
+	for u != "" {
+		resp, err := r.request(ctx, http.MethodGet, u, nil, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		cont, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		page := make(map[string][]string)
+		if err = json.Unmarshal(cont, &page); err != nil {
+			return nil, err
+		}
+		res = append(res, page[field]...)
+		u = ""
+		if m := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next, err := resp.Request.URL.Parse(m[1])
+			if err != nil {
+				return nil, err
+			}
+			u = next.String()
+		}
+	}
+	return res, nil
+}
+
+func (r *registry) Catalog(ctx context.Context) ([]string, error) {
+	return r.list(ctx, fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(Catalog), registryPageSize)), "repositories", "registry:catalog:*")
+}
+
+func (r *registry) Tags(ctx context.Context, repository string) ([]string, error) {
+	return r.list(ctx, fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(TagsList), repository, registryPageSize)), "tags", repositoryScope(repository))
+}
+
+// descriptor reads the descriptor from the response headers
+func descriptor(resp *http.Response) Descriptor {
+	return Descriptor{
+		MediaType: strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0]),
+		Digest:    resp.Header.Get(HeaderDockerContentDigest),
+		Size:      resp.ContentLength,
+	}
+}
+
+func (r *registry) Manifest(ctx context.Context, repository, reference string) (*Manifest, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	u := fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(ManifestsPath), repository, url.PathEscape(reference)))
+	resp, err := r.request(ctx, http.MethodGet, u, manifestMediaTypes, repositoryScope(repository))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	cont, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := &Manifest{}
+	if err = json.Unmarshal(cont, res); err != nil {
+		return nil, err
+	}
+	res.Content = cont
+	res.Descriptor = descriptor(resp)
+	res.Descriptor.Size = int64(len(cont))
+	if res.Descriptor.MediaType == "" {
+		res.Descriptor.MediaType = res.MediaType
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(cont))
+	if res.Descriptor.Digest == "" {
+		res.Descriptor.Digest = digest
+	} else if strings.HasPrefix(res.Descriptor.Digest, "sha256:") && res.Descriptor.Digest != digest {
+		return nil, fmt.Errorf(ErrorDigestMismatch, res.Descriptor.Digest, digest)
+	}
+	return res, nil
+}
+
+func (r *registry) HeadManifest(ctx context.Context, repository, reference string) (Descriptor, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	u := fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(ManifestsPath), repository, url.PathEscape(reference)))
+	resp, err := r.request(ctx, http.MethodHead, u, manifestMediaTypes, repositoryScope(repository))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	_ = resp.Body.Close()
+	return descriptor(resp), nil
+}
+
+func (r *registry) CheckManifest(ctx context.Context, repository, reference, etag string) (res ManifestCheck, err error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	u := fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(ManifestsPath), repository, url.PathEscape(reference)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := r.do(req, repositoryScope(repository))
+	if err != nil {
+		return res, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		_ = resp.Body.Close()
+		return ManifestCheck{ETag: etag, NotModified: true}, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return res, NewStatusError(resp)
+	}
+	_ = resp.Body.Close()
+	res.Descriptor = descriptor(resp)
+	if res.Descriptor.Digest == "" {
+		return res, fmt.Errorf(ErrorManifestWithoutDigest, repository, reference)
+	}
+	res.ETag = resp.Header.Get("ETag")
+	return res, nil
+}
+
+func (r *registry) HeadBlob(ctx context.Context, repository, digest string) (Descriptor, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, err := r.request(ctx, http.MethodHead, r.blobUrl(repository, digest), nil, repositoryScope(repository))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	_ = resp.Body.Close()
+	res := descriptor(resp)
+	if res.Digest == "" {
+		res.Digest = digest
+	}
+	return res, nil
+}
+
+func (r *registry) Blob(ctx context.Context, repository, digest string) (io.ReadCloser, error) {
+	resp, err := r.request(ctx, http.MethodGet, r.blobUrl(repository, digest), nil, repositoryScope(repository))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (r *registry) blobUrl(repository, digest string) string {
+	return fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(BlobsPath), repository, digest))
+}
@@ -0,0 +1,414 @@
+package harbor_api
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	fakeRegistryToken    = "fake-token"
+	fakeRegistryPageSize = 2
+)
+
+type fakeManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// fakeRegistry is an in-process registry v2 behind the token auth of harbor, the tokens were
+// issued by /service/token for the admin and the password
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// manifests and blobs were keyed by the repository and then the tag or the digest
+	manifests map[string]map[string]fakeManifest
+	blobs     map[string]map[string][]byte
+	tokens    int
+	scopes    []string
+	// api serves the harbor api under /api/, if it was set
+	api http.Handler
+	// uploads were keyed by their ids, sessions counts the ids and patches counts the chunks
+	uploads  map[string][]byte
+	sessions int
+	patches  int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{
+		manifests: make(map[string]map[string]fakeManifest),
+		blobs:     make(map[string]map[string][]byte),
+		uploads:   make(map[string][]byte),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func fakeDigest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// putManifest stores the manifest by its digest and the tag, and returns the digest
+func (r *fakeRegistry) putManifest(repository, tag, mediaType string, content []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.storeManifest(repository, tag, mediaType, content)
+}
+
+// storeManifest was putManifest with the lock held
+func (r *fakeRegistry) storeManifest(repository, tag, mediaType string, content []byte) string {
+	digest := fakeDigest(content)
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = make(map[string]fakeManifest)
+	}
+	r.manifests[repository][digest] = fakeManifest{mediaType: mediaType, content: content}
+	if tag != "" {
+		r.manifests[repository][tag] = fakeManifest{mediaType: mediaType, content: content}
+	}
+	return digest
+}
+
+func (r *fakeRegistry) putBlob(repository string, content []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.storeBlob(repository, content)
+}
+
+// storeBlob was putBlob with the lock held
+func (r *fakeRegistry) storeBlob(repository string, content []byte) string {
+	digest := fakeDigest(content)
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = make(map[string][]byte)
+	}
+	r.blobs[repository][digest] = content
+	return digest
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	api := r.api
+	r.mu.Unlock()
+	if api != nil && strings.HasPrefix(req.URL.Path, "/api/") {
+		api.ServeHTTP(w, req)
+		return
+	}
+	if req.URL.Path == "/service/token" {
+		if admin, password, ok := req.BasicAuth(); !ok || admin != "admin" || password != "pwd" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.mu.Lock()
+		r.tokens++
+		r.scopes = append(r.scopes, req.URL.Query()["scope"]...)
+		r.mu.Unlock()
+		_, _ = w.Write([]byte(`{"token":"` + fakeRegistryToken + `","expires_in":1800}`))
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+fakeRegistryToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/service/token",service="harbor-registry"`, r.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "_catalog":
+		repositories := make([]string, 0)
+		for k := range r.manifests {
+			repositories = append(repositories, k)
+		}
+		r.page(w, req, "repositories", repositories)
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.TrimSuffix(path, "/tags/list")
+		tags := make([]string, 0)
+		for k := range r.manifests[repository] {
+			if !strings.HasPrefix(k, "sha256:") {
+				tags = append(tags, k)
+			}
+		}
+		r.page(w, req, "tags", tags)
+	case strings.Contains(path, "/manifests/") && req.Method == http.MethodPut:
+		parts := strings.SplitN(path, "/manifests/", 2)
+		content, _ := ioutil.ReadAll(req.Body)
+		tag := parts[1]
+		if strings.HasPrefix(tag, "sha256:") {
+			tag = ""
+		}
+		w.Header().Set(HeaderDockerContentDigest, r.storeManifest(parts[0], tag, req.Header.Get("Content-Type"), content))
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		m, ok := r.manifests[parts[0]][parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !strings.Contains(req.Header.Get("Accept"), m.mediaType) {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		etag := fmt.Sprintf("%q", fakeDigest(m.content))
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set(HeaderDockerContentDigest, fakeDigest(m.content))
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(m.content)
+		}
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.upload(w, req, strings.SplitN(path, "/blobs/uploads/", 2))
+	case strings.Contains(path, "/blobs/"):
+		parts := strings.SplitN(path, "/blobs/", 2)
+		b, ok := r.blobs[parts[0]][parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(HeaderDockerContentDigest, parts[1])
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(b)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// upload serves the upload sessions of the blobs, parts were the repository and the upload id
+func (r *fakeRegistry) upload(w http.ResponseWriter, req *http.Request, parts []string) {
+	repository, id := parts[0], parts[1]
+	content, _ := ioutil.ReadAll(req.Body)
+	if req.Method == http.MethodPost {
+		if mount, from := req.URL.Query().Get("mount"), req.URL.Query().Get("from"); mount != "" {
+			if b, ok := r.blobs[from][mount]; ok {
+				r.storeBlob(repository, b)
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repository, mount))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.sessions++
+		id = strconv.Itoa(r.sessions)
+		r.uploads[id] = make([]byte, 0)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s?_state=%s", repository, id, id))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	uploaded, ok := r.uploads[id]
+	if !ok || req.URL.Query().Get("_state") != id {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodPatch:
+		if want := fmt.Sprintf("%d-%d", len(uploaded), len(uploaded)+len(content)-1); req.Header.Get("Content-Range") != want {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(uploaded, content...)
+		r.patches++
+		w.Header().Set("Location", req.URL.String())
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		uploaded = append(uploaded, content...)
+		if fakeDigest(uploaded) != req.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, id)
+		w.Header().Set(HeaderDockerContentDigest, r.storeBlob(repository, uploaded))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// page writes a page of the sorted items after the last query, with the Link of the next page
+func (r *fakeRegistry) page(w http.ResponseWriter, req *http.Request, field string, items []string) {
+	sort.Strings(items)
+	last := req.URL.Query().Get("last")
+	start := sort.SearchStrings(items, last)
+	if last != "" && start < len(items) && items[start] == last {
+		start++
+	}
+	end := start + fakeRegistryPageSize
+	if end >= len(items) {
+		end = len(items)
+	} else {
+		w.Header().Set("Link", fmt.Sprintf(`<%s?n=%d&last=%s>; rel="next"`, req.URL.Path, fakeRegistryPageSize, items[end-1]))
+	}
+	_, _ = fmt.Fprintf(w, `{"%s":["%s"]}`, field, strings.Join(items[start:end], `","`))
+}
+
+func TestRegistry(t *testing.T) {
+	r := newFakeRegistry()
+	defer r.Close()
+	config := r.putBlob("proj/team/app", []byte(`{"architecture":"amd64"}`))
+	layer := r.putBlob("proj/team/app", []byte("layer"))
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"%s","size":24},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"%s","size":5}]}`, MediaTypeOCIManifest, config, layer))
+	digest := r.putManifest("proj/team/app", "1.0", MediaTypeOCIManifest, manifest)
+	r.putManifest("proj/team/app", "latest", MediaTypeOCIManifest, manifest)
+	r.putManifest("proj/team/app", "1.1", MediaTypeOCIManifest, manifest)
+	r.putManifest("proj/web", "latest", MediaTypeDockerManifest, []byte(`{"schemaVersion":2}`))
+	r.putManifest("other/base", "latest", MediaTypeDockerManifest, []byte(`{"schemaVersion":2}`))
+
+	h := NewHarbor(r.URL+"/", "admin", "pwd")
+	defer h.Close(context.Background())
+	reg := h.Registry()
+	ctx := context.Background()
+
+	catalog, err := reg.Catalog(ctx)
+	if err != nil {
+		t.Fatalf("registry.Catalog() error = %v", err)
+	}
+	if want := []string{"other/base", "proj/team/app", "proj/web"}; !reflect.DeepEqual(catalog, want) {
+		t.Errorf("registry.Catalog() = %v, want %v", catalog, want)
+	}
+	tags, err := reg.Tags(ctx, "proj/team/app")
+	if err != nil {
+		t.Fatalf("registry.Tags() error = %v", err)
+	}
+	if want := []string{"1.0", "1.1", "latest"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("registry.Tags() = %v, want %v", tags, want)
+	}
+
+	m, err := reg.Manifest(ctx, "proj/team/app", "latest")
+	if err != nil {
+		t.Fatalf("registry.Manifest() error = %v", err)
+	}
+	if m.Descriptor.Digest != digest || m.Descriptor.MediaType != MediaTypeOCIManifest || m.IsIndex() || m.Config.Digest != config || len(m.Layers) != 1 || m.Layers[0].Digest != layer {
+		t.Errorf("registry.Manifest() = %+v", m)
+	}
+	d, err := reg.HeadManifest(ctx, "proj/team/app", digest)
+	if err != nil {
+		t.Fatalf("registry.HeadManifest() error = %v", err)
+	}
+	if want := (Descriptor{MediaType: MediaTypeOCIManifest, Digest: digest, Size: int64(len(manifest))}); d != want {
+		t.Errorf("registry.HeadManifest() = %+v, want %+v", d, want)
+	}
+	if _, err = reg.HeadManifest(ctx, "proj/team/app", "2.0"); !IsNotFound(err) {
+		t.Errorf("registry.HeadManifest() error = %v, want not found", err)
+	}
+
+	if d, err = reg.HeadBlob(ctx, "proj/team/app", layer); err != nil || d.Size != 5 || d.Digest != layer {
+		t.Errorf("registry.HeadBlob() = %+v, %v", d, err)
+	}
+	body, err := reg.Blob(ctx, "proj/team/app", layer)
+	if err != nil {
+		t.Fatalf("registry.Blob() error = %v", err)
+	}
+	cont, err := ioutil.ReadAll(body)
+	_ = body.Close()
+	if err != nil || string(cont) != "layer" {
+		t.Errorf("registry.Blob() = %s, %v", cont, err)
+	}
+	if _, err = reg.Blob(ctx, "proj/team/app", config+"0"); !IsNotFound(err) {
+		t.Errorf("registry.Blob() error = %v, want not found", err)
+	}
+
+	// the tokens were cached by their scopes
+	r.mu.Lock()
+	tokens, scopes := r.tokens, r.scopes
+	r.mu.Unlock()
+	if want := []string{"registry:catalog:*", "repository:proj/team/app:pull"}; tokens != 2 || !reflect.DeepEqual(scopes, want) {
+		t.Errorf("the registry scopes = %v, want %v", scopes, want)
+	}
+
+	if _, err = NewRegistry(r.URL, "admin", "wrong").Tags(ctx, "proj/web"); err == nil {
+		t.Errorf("registry.Tags() succeeded with the wrong credentials")
+	}
+}
+
+func TestRegistry_CheckManifest(t *testing.T) {
+	r := newFakeRegistry()
+	defer r.Close()
+	digest := r.putManifest("proj/app", "latest", MediaTypeDockerManifest, []byte(`{"schemaVersion":2}`))
+	reg := NewRegistry(r.URL, "admin", "pwd")
+	ctx := context.Background()
+
+	got, err := reg.CheckManifest(ctx, "proj/app", "latest", "")
+	if err != nil {
+		t.Fatalf("registry.CheckManifest() error = %v", err)
+	}
+	if got.NotModified || got.Descriptor.Digest != digest || got.ETag != fmt.Sprintf("%q", digest) {
+		t.Errorf("registry.CheckManifest() = %+v, want the digest %v", got, digest)
+	}
+	if got, err = reg.CheckManifest(ctx, "proj/app", "latest", got.ETag); err != nil || !got.NotModified {
+		t.Errorf("registry.CheckManifest() = %+v, %v, want not modified", got, err)
+	}
+	moved := r.putManifest("proj/app", "latest", MediaTypeDockerManifest, []byte(`{"schemaVersion":2,"layers":[]}`))
+	if got, err = reg.CheckManifest(ctx, "proj/app", "latest", got.ETag); err != nil || got.NotModified || got.Descriptor.Digest != moved {
+		t.Errorf("registry.CheckManifest() = %+v, %v, want the digest %v", got, err, moved)
+	}
+	if _, err = reg.CheckManifest(ctx, "proj/app", "deleted", ""); !IsNotFound(err) {
+		t.Errorf("registry.CheckManifest() error = %v, want not found", err)
+	}
+}
+
+func TestHarbor_RegistryPolling(t *testing.T) {
+	r := newFakeRegistry()
+	defer r.Close()
+	var requested int32
+	// the artifact api of harbor was only requested once the registry failed
+	r.mu.Lock()
+	r.api = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requested, 1)
+		_, _ = w.Write([]byte(`{"digest":"` + mirrorDigestB + `"}`))
+	})
+	r.mu.Unlock()
+	digest := r.putManifest("proj/app", "latest", MediaTypeDockerManifest, []byte(`{"schemaVersion":2}`))
+
+	h := NewHarbor(r.URL, "admin", "pwd", WithRegistryPolling())
+	defer h.Close(context.Background())
+	w, err := h.Watch(Option{Project: "proj", Repository: "app", Tag: "latest", SendInitialEvents: true})
+	if err != nil {
+		t.Fatalf("harbor.Watch() error = %v", err)
+	}
+	defer w.Stop()
+	select {
+	case e := <-w.ResultChan():
+		if e.Type != watch.Added || e.Object.(*ImageDigestChange).Spec.Sha256 != digest {
+			t.Errorf("event = %v, want Added with %v from the registry", e, digest)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no Added event from the registry")
+	}
+	if n := atomic.LoadInt32(&requested); n != 0 {
+		t.Errorf("the artifact api was requested %d times", n)
+	}
+
+	// the registry failed, so that the watch falls back to the artifact api
+	w2, err := h.Watch(Option{Project: "proj", Repository: "missing", Tag: "latest", SendInitialEvents: true})
+	if err != nil {
+		t.Fatalf("harbor.Watch() error = %v", err)
+	}
+	defer w2.Stop()
+	select {
+	case e := <-w2.ResultChan():
+		if e.Type != watch.Added || e.Object.(*ImageDigestChange).Spec.Sha256 != mirrorDigestB {
+			t.Errorf("event = %v, want Added with %v from the artifact api", e, mirrorDigestB)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no Added event from the artifact api")
+	}
+}
@@ -0,0 +1,136 @@
+package harbor_api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/goharbor/harbor/src/common/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorPartialSearch = "error: the repository listing of the search failed, only the search api results were returned:%v"
+
+	// defaultSearchTimeout limits every harbor of a hub search, so that a slow one doesn't hold the others
+	defaultSearchTimeout = time.Second * 10
+)
+
+// SearchRepository is a repository in the response of /api/v2.0/search
+type SearchRepository struct {
+	ProjectID      int64  `json:"project_id"`
+	ProjectName    string `json:"project_name"`
+	ProjectPublic  bool   `json:"project_public"`
+	RepositoryName string `json:"repository_name"`
+	PullCount      int64  `json:"pull_count"`
+	ArtifactCount  int64  `json:"artifact_count"`
+}
+
+// SearchResult is the response of /api/v2.0/search
+type SearchResult struct {
+	Project    []models.Project   `json:"project"`
+	Repository []SearchRepository `json:"repository"`
+}
+
+// PartialSearchError was returned by harbor.Search along with the results of the search api,
+// once the repository listing which fills the rest of them failed
+type PartialSearchError struct {
+	Err error
+}
+
+func (e *PartialSearchError) Error() string {
+	return fmt.Sprintf(ErrorPartialSearch, e.Err)
+}
+
+func (e *PartialSearchError) Unwrap() error {
+	return e.Err
+}
+
+// HubSearchProject is a project found by Hub.Search, Url was the harbor which it came from
+type HubSearchProject struct {
+	Url     string         `json:"url"`
+	Project models.Project `json:"project"`
+}
+
+// HubSearchRepository is a repository found by Hub.Search, Url was the harbor which it came from
+type HubSearchRepository struct {
+	Url        string           `json:"url"`
+	Repository SearchRepository `json:"repository"`
+}
+
+// HubSearchFailure is a harbor which failed or timed out during Hub.Search.
+// Partial was true if the results of the harbor were still merged, since only its repository listing failed.
+type HubSearchFailure struct {
+	Url     string `json:"url"`
+	Error   string `json:"error"`
+	Partial bool   `json:"partial,omitempty"`
+}
+
+// HubSearchResult merges the results of all the harbors, sorted by the url and the name.
+// The failed harbors were reported in Failures instead of failing the whole search.
+type HubSearchResult struct {
+	Projects     []HubSearchProject    `json:"projects"`
+	Repositories []HubSearchRepository `json:"repositories"`
+	Failures     []HubSearchFailure    `json:"failures,omitempty"`
+}
+
+// Search searches all the harbors concurrently, each one was limited by defaultSearchTimeout
+func (h *hub) Search(ctx context.Context, query string) HubSearchResult {
+	h.mu.RLock()
+	harbors := make([]*hubHarbor, 0, len(h.harbors))
+	for _, v := range h.harbors {
+		harbors = append(harbors, v)
+	}
+	h.mu.RUnlock()
+	res := HubSearchResult{
+		Projects:     make([]HubSearchProject, 0),
+		Repositories: make([]HubSearchRepository, 0),
+		Failures:     make([]HubSearchFailure, 0),
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, v := range harbors {
+		wg.Add(1)
+		go func(t *hubHarbor) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, defaultSearchTimeout)
+			defer cancel()
+			found, err := t.harbor.Search(ctx, query)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				var partial *PartialSearchError
+				res.Failures = append(res.Failures, HubSearchFailure{Url: t.url, Error: err.Error(), Partial: errors.As(err, &partial)})
+				if partial == nil {
+					return
+				}
+			}
+			for _, p := range found.Project {
+				res.Projects = append(res.Projects, HubSearchProject{Url: t.url, Project: p})
+			}
+			for _, r := range found.Repository {
+				res.Repositories = append(res.Repositories, HubSearchRepository{Url: t.url, Repository: r})
+			}
+		}(v)
+	}
+	wg.Wait()
+	sort.Slice(res.Projects, func(i, j int) bool {
+		if res.Projects[i].Url != res.Projects[j].Url {
+			return res.Projects[i].Url < res.Projects[j].Url
+		}
+		return res.Projects[i].Project.Name < res.Projects[j].Project.Name
+	})
+	sort.Slice(res.Repositories, func(i, j int) bool {
+		if res.Repositories[i].Url != res.Repositories[j].Url {
+			return res.Repositories[i].Url < res.Repositories[j].Url
+		}
+		return res.Repositories[i].Repository.RepositoryName < res.Repositories[j].Repository.RepositoryName
+	})
+	sort.Slice(res.Failures, func(i, j int) bool {
+		return res.Failures[i].Url < res.Failures[j].Url
+	})
+	return res
+}
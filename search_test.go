@@ -0,0 +1,77 @@
+package harbor_api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_hub_Search(t *testing.T) {
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2.0/search":
+			if r.URL.Query().Get("q") != "app" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`{"project":[{"project_id":2,"name":"app"}],"repository":[{"project_id":1,"project_name":"proj","repository_name":"proj/team/app","pull_count":3}]}`))
+		case "/api/v2.0/repositories":
+			if r.URL.Query().Get("q") != "name=~app" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`[{"project_id":1,"name":"proj/team/app","pull_count":3},{"project_id":3,"name":"other/app-web","pull_count":5}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s1.Close()
+	s2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2.0/search":
+			_, _ = w.Write([]byte(`{"project":[],"repository":[{"project_id":7,"project_name":"base","repository_name":"base/app","pull_count":1}]}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer s2.Close()
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s3.Close()
+
+	h := NewHub([]Config{{Url: s1.URL}, {Url: s2.URL}, {Url: s3.URL}})
+	got := h.Search(context.Background(), "app")
+
+	wantRepositories := []HubSearchRepository{
+		{Url: s1.URL, Repository: SearchRepository{ProjectID: 3, ProjectName: "other", RepositoryName: "other/app-web", PullCount: 5}},
+		{Url: s1.URL, Repository: SearchRepository{ProjectID: 1, ProjectName: "proj", RepositoryName: "proj/team/app", PullCount: 3}},
+		{Url: s2.URL, Repository: SearchRepository{ProjectID: 7, ProjectName: "base", RepositoryName: "base/app", PullCount: 1}},
+	}
+	if s2.URL < s1.URL {
+		wantRepositories = append(wantRepositories[2:], wantRepositories[:2]...)
+	}
+	if !reflect.DeepEqual(got.Repositories, wantRepositories) {
+		t.Errorf("hub.Search() repositories = %+v, want %+v", got.Repositories, wantRepositories)
+	}
+	if len(got.Projects) != 1 || got.Projects[0].Url != s1.URL || got.Projects[0].Project.Name != "app" {
+		t.Errorf("hub.Search() projects = %+v", got.Projects)
+	}
+	// the repository listing of s2 failed, so its results of the search api were merged with a partial failure
+	failures := map[string]bool{}
+	for _, v := range got.Failures {
+		if v.Error == "" {
+			t.Errorf("hub.Search() failure = %+v, want the error", v)
+		}
+		failures[v.Url] = v.Partial
+	}
+	if want := map[string]bool{s2.URL: true, s3.URL: false}; !reflect.DeepEqual(failures, want) {
+		t.Errorf("hub.Search() failures = %+v, want the partial %s and the closed %s", got.Failures, s2.URL, s3.URL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got = h.Search(ctx, "app"); len(got.Failures) != 3 {
+		t.Errorf("hub.Search() with a canceled context failures = %+v, want all the harbors", got.Failures)
+	}
+}
@@ -0,0 +1,100 @@
+package harbor_api
+
+import (
+	"github.com/Shanghai-Lunara/pkg/zaplogger"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/apimachinery/pkg/runtime/serializer/streaming"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+var (
+	// jsonSerializer encodes the objects as they are, and decodes them by the kinds registered in Scheme
+	jsonSerializer = json.NewSerializerWithOptions(json.DefaultMetaFactory, Scheme, Scheme, json.SerializerOptions{})
+	// protobufSerializer encodes the objects inside runtime.Unknown with the protobuf prefix of Kubernetes,
+	// and protobufRawSerializer encodes the metav1.WatchEvent of the stream around them
+	protobufSerializer    = protobuf.NewSerializer(Scheme, Scheme)
+	protobufRawSerializer = protobuf.NewRawSerializer(Scheme, Scheme)
+)
+
+// EventEncoder writes the watch events as a stream of metav1.WatchEvent in JSON or protobuf
+type EventEncoder struct {
+	encoder    streaming.Encoder
+	serializer runtime.Encoder
+}
+
+func NewEventEncoder(w io.Writer) *EventEncoder {
+	return &EventEncoder{encoder: streaming.NewEncoder(w, jsonSerializer), serializer: jsonSerializer}
+}
+
+// NewProtobufEventEncoder writes the events length-delimited in protobuf, like the protobuf watches of Kubernetes
+func NewProtobufEventEncoder(w io.Writer) *EventEncoder {
+	return &EventEncoder{
+		encoder:    streaming.NewEncoder(protobuf.LengthDelimitedFramer.NewFrameWriter(w), protobufRawSerializer),
+		serializer: protobufSerializer,
+	}
+}
+
+func (e *EventEncoder) Encode(event watch.Event) error {
+	raw, err := runtime.Encode(e.serializer, event.Object)
+	if err != nil {
+		return err
+	}
+	return e.encoder.Encode(&metav1.WatchEvent{
+		Type:   string(event.Type),
+		Object: runtime.RawExtension{Raw: raw},
+	})
+}
+
+// eventDecoder implements watch.Decoder for the stream written by EventEncoder,
+// the objects were decoded by the UniversalDeserializer which recognizes both JSON and protobuf
+type eventDecoder struct {
+	decoder streaming.Decoder
+}
+
+func NewEventDecoder(r io.ReadCloser) watch.Decoder {
+	return &eventDecoder{decoder: streaming.NewDecoder(json.Framer.NewFrameReader(r), jsonSerializer)}
+}
+
+// NewProtobufEventDecoder implements watch.Decoder for the stream written by NewProtobufEventEncoder
+func NewProtobufEventDecoder(r io.ReadCloser) watch.Decoder {
+	return &eventDecoder{decoder: streaming.NewDecoder(protobuf.LengthDelimitedFramer.NewFrameReader(r), protobufRawSerializer)}
+}
+
+func (d *eventDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var got metav1.WatchEvent
+	if _, _, err := d.decoder.Decode(nil, &got); err != nil {
+		return "", nil, err
+	}
+	obj, err := runtime.Decode(Codecs.UniversalDeserializer(), got.Object.Raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return watch.EventType(got.Type), obj, nil
+}
+
+func (d *eventDecoder) Close() {
+	if err := d.decoder.Close(); err != nil {
+		zaplogger.Sugar().Error(err)
+	}
+}
+
+// errorReporter reports the decoding errors as watch.Error events
+type errorReporter struct{}
+
+func (errorReporter) AsObject(err error) runtime.Object {
+	return NewErrorStatus(err)
+}
+
+// NewStreamWatcher turns the stream written by EventEncoder back into a watch.Interface
+func NewStreamWatcher(r io.ReadCloser) watch.Interface {
+	return watch.NewStreamWatcher(NewEventDecoder(r), errorReporter{})
+}
+
+// NewProtobufStreamWatcher turns the stream written by NewProtobufEventEncoder back into a watch.Interface
+func NewProtobufStreamWatcher(r io.ReadCloser) watch.Interface {
+	return watch.NewStreamWatcher(NewProtobufEventDecoder(r), errorReporter{})
+}
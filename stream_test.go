@@ -0,0 +1,94 @@
+package harbor_api
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestEventEncoder_StreamWatcher(t *testing.T) {
+	opt := Option{Project: "p", Repository: "r", Tag: "latest", Sha256: "sha256:b", Platform: "linux/amd64"}
+	events := []watch.Event{
+		{Type: watch.Added, Object: NewImageDigestChange(opt, "")},
+		{Type: watch.Modified, Object: NewImageDigestChange(opt, "sha256:a")},
+		{Type: watch.Error, Object: NewErrorStatus(&StatusError{Code: http.StatusServiceUnavailable, Body: "unavailable"})},
+		{Type: watch.Deleted, Object: NewImageDigestChange(opt, "")},
+	}
+	tests := []struct {
+		name    string
+		encoder func(w io.Writer) *EventEncoder
+		watcher func(r io.ReadCloser) watch.Interface
+	}{
+		{name: "json", encoder: NewEventEncoder, watcher: NewStreamWatcher},
+		{name: "protobuf", encoder: NewProtobufEventEncoder, watcher: NewProtobufStreamWatcher},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			e := tt.encoder(buf)
+			for _, v := range events {
+				if err := e.Encode(v); err != nil {
+					t.Fatalf("EventEncoder.Encode() error = %v", err)
+				}
+			}
+			w := tt.watcher(ioutil.NopCloser(buf))
+			got := make([]watch.Event, 0)
+			for v := range w.ResultChan() {
+				got = append(got, v)
+			}
+			if !reflect.DeepEqual(got, events) {
+				t.Errorf("StreamWatcher events = %v, want %v", got, events)
+			}
+		})
+	}
+}
+
+func TestImageDigestChange_Protobuf(t *testing.T) {
+	info, ok := runtime.SerializerInfoForMediaType(Codecs.SupportedMediaTypes(), runtime.ContentTypeProtobuf)
+	if !ok {
+		t.Fatalf("Codecs.SupportedMediaTypes() = %v, want %v", Codecs.SupportedMediaTypes(), runtime.ContentTypeProtobuf)
+	}
+	in := NewImageDigestChange(Option{Project: "p", Repository: "team/app", Tag: "1.0", Sha256: "sha256:b", Platform: "linux/arm64"}, "sha256:a")
+	raw, err := runtime.Encode(info.Serializer, in)
+	if err != nil {
+		t.Fatalf("runtime.Encode() error = %v", err)
+	}
+	out, err := runtime.Decode(Codecs.UniversalDeserializer(), raw)
+	if err != nil {
+		t.Fatalf("runtime.Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("runtime.Decode() = %v, want %v", out, in)
+	}
+	if err = out.(*ImageDigestChange).Unmarshal([]byte{0x0a}); err == nil {
+		t.Errorf("ImageDigestChange.Unmarshal() error = nil, want truncated")
+	}
+}
+
+func TestImageDigestChange_Scheme(t *testing.T) {
+	in := NewImageDigestChange(Option{Project: "p", Repository: "team/app", Tag: "1.0", Sha256: "sha256:b"}, "sha256:a")
+	raw, err := runtime.Encode(Codecs.LegacyCodec(SchemeGroupVersion), in)
+	if err != nil {
+		t.Fatalf("runtime.Encode() error = %v", err)
+	}
+	out, err := runtime.Decode(Codecs.UniversalDecoder(SchemeGroupVersion), raw)
+	if err != nil {
+		t.Fatalf("runtime.Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("runtime.Decode() = %v, want %v", out, in)
+	}
+	if got := out.(*ImageDigestChange).Option().ImageName(); got != "p/team/app:1.0" {
+		t.Errorf("ImageDigestChange.Option().ImageName() = %v, want %v", got, "p/team/app:1.0")
+	}
+	opt := &Option{}
+	opt.GetObjectKind().SetGroupVersionKind(SchemeGroupVersion.WithKind("Option"))
+	if opt.APIVersion != SchemeGroupVersion.String() || opt.Kind != "Option" {
+		t.Errorf("Option.SetGroupVersionKind() = %v/%v, want %v/Option", opt.APIVersion, opt.Kind, SchemeGroupVersion)
+	}
+}
@@ -0,0 +1,240 @@
+package harbor_api
+
+import (
+	"fmt"
+	"github.com/goharbor/harbor/src/common/models"
+	"github.com/goharbor/harbor/src/controller/artifact"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ImageDigestChange is the object sent by the watches, it carries the digest of the watched image.
+// The name was the image name, and the resourceVersion was the digest.
+type ImageDigestChange struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ImageDigestChangeSpec `json:"spec"`
+}
+
+// +k8s:deepcopy-gen=true
+
+type ImageDigestChangeSpec struct {
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Sha256     string `json:"sha256"`
+	// PreviousSha256 was set by watch.Modified
+	PreviousSha256 string `json:"previousSha256,omitempty"`
+	// Platform was set if the watch selected a platform, then Sha256 was the digest of its manifest
+	Platform string `json:"platform,omitempty"`
+}
+
+func NewImageDigestChange(opt Option, previousSha256 string) *ImageDigestChange {
+	return &ImageDigestChange{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: SchemeGroupVersion.String(),
+			Kind:       "ImageDigestChange",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            opt.ImageName(),
+			ResourceVersion: opt.Sha256,
+		},
+		Spec: ImageDigestChangeSpec{
+			Project:        opt.Project,
+			Repository:     opt.Repository,
+			Tag:            opt.Tag,
+			Sha256:         opt.Sha256,
+			PreviousSha256: previousSha256,
+			Platform:       opt.Platform,
+		},
+	}
+}
+
+// Option returns the Option which resumes a watch from this change
+func (c *ImageDigestChange) Option() Option {
+	return Option{
+		Project:    c.Spec.Project,
+		Repository: c.Spec.Repository,
+		Tag:        c.Spec.Tag,
+		Sha256:     c.Spec.Sha256,
+		Platform:   c.Spec.Platform,
+	}
+}
+
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Project is a harbor project, the name was the project name
+type Project struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ProjectSpec `json:"spec"`
+}
+
+// +k8s:deepcopy-gen=true
+
+type ProjectSpec struct {
+	ProjectID  int64             `json:"projectId"`
+	Name       string            `json:"name"`
+	OwnerName  string            `json:"ownerName,omitempty"`
+	RepoCount  int64             `json:"repoCount"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	UpdateTime metav1.Time       `json:"updateTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type ProjectList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Project `json:"items"`
+}
+
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Repository is a harbor repository, the namespace was the project name
+// and the name was the repository name without the project
+type Repository struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec RepositorySpec `json:"spec"`
+}
+
+// +k8s:deepcopy-gen=true
+
+type RepositorySpec struct {
+	RepositoryID int64       `json:"repositoryId"`
+	ProjectID    int64       `json:"projectId"`
+	Project      string      `json:"project"`
+	Name         string      `json:"name"`
+	Description  string      `json:"description,omitempty"`
+	PullCount    int64       `json:"pullCount"`
+	UpdateTime   metav1.Time `json:"updateTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type RepositoryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Repository `json:"items"`
+}
+
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Artifact is a harbor artifact, the namespace was the project name
+// and the name was the repository name and the digest joined by "@"
+type Artifact struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ArtifactSpec `json:"spec"`
+}
+
+// +k8s:deepcopy-gen=true
+
+type ArtifactSpec struct {
+	ArtifactID int64       `json:"artifactId"`
+	Project    string      `json:"project"`
+	Repository string      `json:"repository"`
+	Digest     string      `json:"digest"`
+	Type       string      `json:"type,omitempty"`
+	MediaType  string      `json:"mediaType,omitempty"`
+	Size       int64       `json:"size"`
+	PushTime   metav1.Time `json:"pushTime,omitempty"`
+	Tags       []string    `json:"tags,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type ArtifactList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Artifact `json:"items"`
+}
+
+func NewProject(p models.Project) *Project {
+	return &Project{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: SchemeGroupVersion.String(),
+			Kind:       "Project",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: p.Name,
+		},
+		Spec: ProjectSpec{
+			ProjectID:  p.ProjectID,
+			Name:       p.Name,
+			OwnerName:  p.OwnerName,
+			RepoCount:  p.RepoCount,
+			Metadata:   p.Metadata,
+			UpdateTime: metav1.NewTime(p.UpdateTime),
+		},
+	}
+}
+
+// NewRepository converts the harbor repository, whose name was prefixed by the project
+func NewRepository(projectName string, r models.RepoRecord) *Repository {
+	name := strings.TrimPrefix(r.Name, projectName+"/")
+	return &Repository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: SchemeGroupVersion.String(),
+			Kind:       "Repository",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: projectName,
+			Name:      name,
+		},
+		Spec: RepositorySpec{
+			RepositoryID: r.RepositoryID,
+			ProjectID:    r.ProjectID,
+			Project:      projectName,
+			Name:         name,
+			Description:  r.Description,
+			PullCount:    r.PullCount,
+			UpdateTime:   metav1.NewTime(r.UpdateTime),
+		},
+	}
+}
+
+func NewArtifact(projectName string, repositoryName string, a artifact.Artifact) *Artifact {
+	tags := make([]string, 0, len(a.Tags))
+	for _, t := range a.Tags {
+		tags = append(tags, t.Name)
+	}
+	return &Artifact{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: SchemeGroupVersion.String(),
+			Kind:       "Artifact",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: projectName,
+			Name:      fmt.Sprintf("%s@%s", repositoryName, a.Digest),
+		},
+		Spec: ArtifactSpec{
+			ArtifactID: a.ID,
+			Project:    projectName,
+			Repository: repositoryName,
+			Digest:     a.Digest,
+			Type:       a.Type,
+			MediaType:  a.MediaType,
+			Size:       a.Size,
+			PushTime:   metav1.NewTime(a.PushTime),
+			Tags:       tags,
+		},
+	}
+}
@@ -0,0 +1,195 @@
+package harbor_api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+const (
+	ErrorUploadWithoutLocation = "error: the registry sent no location of the upload of the repository:%s"
+
+	// defaultChunkSize was used by PushBlobChunked if the chunk size was not positive
+	defaultChunkSize     = 5 << 20
+	mediaTypeOctetStream = "application/octet-stream"
+)
+
+// pushScope returns the token scope which pushes to the repository
+func pushScope(repository string) string {
+	return repositoryScope(repository, "pull", "push")
+}
+
+// send sends the request with the body, and returns a StatusError unless the registry responds with one of
+// the expected status codes. The body of the response was drained, so that only its headers were returned.
+func (r *registry) send(ctx context.Context, method, u string, header http.Header, body []byte, expected []int, scopes ...string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	// the body of bytes.Reader can be replayed after the token challenge
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := r.do(req, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range expected {
+		if resp.StatusCode == v {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+			return resp, nil
+		}
+	}
+	return nil, NewStatusError(resp)
+}
+
+// location resolves the Location of the upload, which may be relative to the request
+func location(repository string, resp *http.Response) (*url.URL, error) {
+	l := resp.Header.Get("Location")
+	if l == "" {
+		return nil, fmt.Errorf(ErrorUploadWithoutLocation, repository)
+	}
+	return resp.Request.URL.Parse(l)
+}
+
+// withDigest returns the location which completes the upload with the digest
+func withDigest(l *url.URL, digest string) string {
+	u := *l
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// startUpload starts an upload session of the repository, and returns its location
+func (r *registry) startUpload(ctx context.Context, repository string) (*url.URL, error) {
+	resp, err := r.send(ctx, http.MethodPost, fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(UploadsPath), repository)), nil, nil,
+		[]int{http.StatusAccepted}, pushScope(repository))
+	if err != nil {
+		return nil, err
+	}
+	return location(repository, resp)
+}
+
+func (r *registry) PushBlob(ctx context.Context, repository string, content []byte) (Descriptor, error) {
+	res := Descriptor{
+		MediaType: mediaTypeOctetStream,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		Size:      int64(len(content)),
+	}
+	if _, err := r.HeadBlob(ctx, repository, res.Digest); err == nil {
+		return res, nil
+	}
+	l, err := r.startUpload(ctx, repository)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	header := http.Header{"Content-Type": []string{mediaTypeOctetStream}}
+	if _, err = r.send(ctx, http.MethodPut, withDigest(l, res.Digest), header, content, []int{http.StatusCreated}, pushScope(repository)); err != nil {
+		return Descriptor{}, err
+	}
+	return res, nil
+}
+
+func (r *registry) PushBlobChunked(ctx context.Context, repository string, rd io.Reader, chunkSize int) (Descriptor, error) {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	l, err := r.startUpload(ctx, repository)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	var (
+		h      = sha256.New()
+		buf    = make([]byte, chunkSize)
+		offset int64
+	)
+	for {
+		n, err := io.ReadFull(rd, buf)
+		if n > 0 {
+			_, _ = h.Write(buf[:n])
+			header := http.Header{
+				"Content-Type":  []string{mediaTypeOctetStream},
+				"Content-Range": []string{fmt.Sprintf("%d-%d", offset, offset+int64(n)-1)},
+			}
+			resp, err := r.send(ctx, http.MethodPatch, l.String(), header, buf[:n], []int{http.StatusAccepted}, pushScope(repository))
+			if err != nil {
+				return Descriptor{}, err
+			}
+			// every chunk moves the upload to a new location
+			if l, err = location(repository, resp); err != nil {
+				return Descriptor{}, err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Descriptor{}, err
+		}
+	}
+	res := Descriptor{
+		MediaType: mediaTypeOctetStream,
+		Digest:    fmt.Sprintf("sha256:%x", h.Sum(nil)),
+		Size:      offset,
+	}
+	if _, err = r.send(ctx, http.MethodPut, withDigest(l, res.Digest), nil, nil, []int{http.StatusCreated}, pushScope(repository)); err != nil {
+		return Descriptor{}, err
+	}
+	return res, nil
+}
+
+func (r *registry) MountBlob(ctx context.Context, repository, fromRepository, digest string) (bool, error) {
+	scopes := []string{pushScope(repository), repositoryScope(fromRepository)}
+	q := url.Values{}
+	q.Set("mount", digest)
+	q.Set("from", fromRepository)
+	u := fmt.Sprintf("%s/%s?%s", r.url, fmt.Sprintf(string(UploadsPath), repository), q.Encode())
+	resp, err := r.send(ctx, http.MethodPost, u, nil, nil, []int{http.StatusCreated, http.StatusAccepted}, scopes...)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusCreated {
+		return true, nil
+	}
+	// the registry started an upload session instead of mounting, which was canceled
+	if l, err := location(repository, resp); err == nil {
+		_, _ = r.send(ctx, http.MethodDelete, l.String(), nil, nil, []int{http.StatusNoContent}, scopes...)
+	}
+	return false, nil
+}
+
+func (r *registry) PushManifest(ctx context.Context, repository, reference, mediaType string, content []byte) (Descriptor, error) {
+	u := fmt.Sprintf("%s/%s", r.url, fmt.Sprintf(string(ManifestsPath), repository, url.PathEscape(reference)))
+	header := http.Header{"Content-Type": []string{mediaType}}
+	resp, err := r.send(ctx, http.MethodPut, u, header, content, []int{http.StatusCreated}, pushScope(repository))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	res := Descriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		Size:      int64(len(content)),
+	}
+	if d := resp.Header.Get(HeaderDockerContentDigest); d != "" && d != res.Digest {
+		return Descriptor{}, fmt.Errorf(ErrorDigestMismatch, d, res.Digest)
+	}
+	return res, nil
+}
+
+func (r *registry) Tag(ctx context.Context, repository, reference, tag string) (Descriptor, error) {
+	m, err := r.Manifest(ctx, repository, reference)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return r.PushManifest(ctx, repository, tag, m.Descriptor.MediaType, m.Content)
+}
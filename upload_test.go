@@ -0,0 +1,160 @@
+package harbor_api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRegistry_PushBlob(t *testing.T) {
+	r := newFakeRegistry()
+	defer r.Close()
+	reg := NewRegistry(r.URL, "admin", "pwd")
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		content   []byte
+		chunked   bool
+		chunkSize int
+		patches   int
+	}{
+		{name: "TestRegistry_PushBlob_monolithic", content: []byte("monolithic layer")},
+		{name: "TestRegistry_PushBlob_existing", content: []byte("monolithic layer")},
+		{name: "TestRegistry_PushBlob_chunked", content: []byte("a chunked layer of 32 bytes....."), chunked: true, chunkSize: 8, patches: 4},
+		{name: "TestRegistry_PushBlob_chunked_rest", content: []byte("chunked rest"), chunked: true, chunkSize: 5, patches: 3},
+		{name: "TestRegistry_PushBlob_chunked_default", content: []byte("one chunk"), chunked: true, patches: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.mu.Lock()
+			patches := r.patches
+			r.mu.Unlock()
+			var (
+				got Descriptor
+				err error
+			)
+			if tt.chunked {
+				got, err = reg.PushBlobChunked(ctx, "proj/app", bytes.NewReader(tt.content), tt.chunkSize)
+			} else {
+				got, err = reg.PushBlob(ctx, "proj/app", tt.content)
+			}
+			if err != nil {
+				t.Fatalf("registry.PushBlob() error = %v", err)
+			}
+			if want := (Descriptor{MediaType: mediaTypeOctetStream, Digest: fakeDigest(tt.content), Size: int64(len(tt.content))}); got != want {
+				t.Errorf("registry.PushBlob() = %+v, want %+v", got, want)
+			}
+			r.mu.Lock()
+			stored, uploads := r.blobs["proj/app"][got.Digest], len(r.uploads)
+			patches = r.patches - patches
+			r.mu.Unlock()
+			if !bytes.Equal(stored, tt.content) || uploads != 0 {
+				t.Errorf("the stored blob = %s with %d open uploads, want %s", stored, uploads, tt.content)
+			}
+			if patches != tt.patches {
+				t.Errorf("the chunks = %d, want %d", patches, tt.patches)
+			}
+		})
+	}
+	r.mu.Lock()
+	sessions := r.sessions
+	r.mu.Unlock()
+	if sessions != 4 {
+		t.Errorf("the upload sessions = %d, want 4 since the existing blob was skipped", sessions)
+	}
+}
+
+func TestRegistry_MountBlob(t *testing.T) {
+	r := newFakeRegistry()
+	defer r.Close()
+	layer := r.putBlob("base/os", []byte("base layer"))
+	reg := NewRegistry(r.URL, "admin", "pwd")
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		from   string
+		digest string
+		want   bool
+	}{
+		{name: "TestRegistry_MountBlob_mounted", from: "base/os", digest: layer, want: true},
+		{name: "TestRegistry_MountBlob_missing", from: "base/os", digest: fakeDigest([]byte("missing")), want: false},
+		{name: "TestRegistry_MountBlob_other_repository", from: "base/other", digest: layer, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := reg.MountBlob(ctx, "proj/app", tt.from, tt.digest)
+			if err != nil {
+				t.Fatalf("registry.MountBlob() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("registry.MountBlob() = %v, want %v", got, tt.want)
+			}
+			r.mu.Lock()
+			_, ok := r.blobs["proj/app"][tt.digest]
+			uploads := len(r.uploads)
+			r.mu.Unlock()
+			if (tt.want && !ok) || uploads != 0 {
+				t.Errorf("the mounted blob = %v with %d open uploads", ok, uploads)
+			}
+		})
+	}
+	r.mu.Lock()
+	scopes := r.scopes
+	r.mu.Unlock()
+	if want := []string{"repository:proj/app:pull,push", "repository:base/os:pull"}; len(scopes) < 2 || !reflect.DeepEqual(scopes[:2], want) {
+		t.Errorf("the registry scopes = %v, want %v first", scopes, want)
+	}
+}
+
+func TestRegistry_PushManifest(t *testing.T) {
+	r := newFakeRegistry()
+	defer r.Close()
+	reg := NewRegistry(r.URL, "admin", "pwd")
+	ctx := context.Background()
+
+	config, err := reg.PushBlob(ctx, "proj/app", []byte(`{"architecture":"amd64"}`))
+	if err != nil {
+		t.Fatalf("registry.PushBlob() error = %v", err)
+	}
+	layer, err := reg.PushBlob(ctx, "proj/app", []byte("layer"))
+	if err != nil {
+		t.Fatalf("registry.PushBlob() error = %v", err)
+	}
+	content := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"%s","size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"%s","size":%d}]}`,
+		MediaTypeOCIManifest, config.Digest, config.Size, layer.Digest, layer.Size))
+	d, err := reg.PushManifest(ctx, "proj/app", "1.0", MediaTypeOCIManifest, content)
+	if err != nil {
+		t.Fatalf("registry.PushManifest() error = %v", err)
+	}
+	if want := (Descriptor{MediaType: MediaTypeOCIManifest, Digest: fakeDigest(content), Size: int64(len(content))}); d != want {
+		t.Errorf("registry.PushManifest() = %+v, want %+v", d, want)
+	}
+
+	tagged, err := reg.Tag(ctx, "proj/app", "1.0", "latest")
+	if err != nil {
+		t.Fatalf("registry.Tag() error = %v", err)
+	}
+	if tagged != d {
+		t.Errorf("registry.Tag() = %+v, want %+v", tagged, d)
+	}
+	if _, err = reg.Tag(ctx, "proj/app", "2.0", "stable"); !IsNotFound(err) {
+		t.Errorf("registry.Tag() error = %v, want not found", err)
+	}
+
+	m, err := reg.Manifest(ctx, "proj/app", "latest")
+	if err != nil {
+		t.Fatalf("registry.Manifest() error = %v", err)
+	}
+	if m.Descriptor != d || m.Config.Digest != config.Digest || len(m.Layers) != 1 || m.Layers[0].Digest != layer.Digest {
+		t.Errorf("registry.Manifest() = %+v", m)
+	}
+	tags, err := reg.Tags(ctx, "proj/app")
+	if err != nil {
+		t.Fatalf("registry.Tags() error = %v", err)
+	}
+	if want := []string{"1.0", "latest"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("registry.Tags() = %v, want %v", tags, want)
+	}
+}
@@ -1,171 +1,971 @@
 package harbor_api
 
 import (
+	"container/heap"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Shanghai-Lunara/pkg/zaplogger"
 	"github.com/goharbor/harbor/src/controller/artifact"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/watch"
 	"math/rand"
-	"strings"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	ErrorImageWatchExpired    = "error: the watch of image:%s has expired"
+	ErrorImageWatchIdle       = "error: the watch of image:%s has had no watcher for %v"
+	ErrorImageWatchNotExisted = "error: the watch of image:%s was not existed"
+)
+
 const (
 	maxQueuedEvents  = 1000
-	maxRemovedChan   = 1000
-	loopTickTimeInMs = 1500
+	maxSchedulerIdle = time.Minute
+	defaultWorkers   = 8
+
+	defaultInterval    = time.Millisecond * 1500
+	defaultJitter      = time.Millisecond * 1000
+	defaultMaxFailures = 5
+	defaultBackoff     = time.Second * 2
+	defaultMaxBackoff  = time.Minute
+
+	// batchWindow bounds how early a queued image was polled along with a due image of the same repository
+	batchWindow = time.Second
 )
 
+// Policy controls how often a watched image was polled and how it reacts to the failed polls.
+// The zero fields fall back to the defaults of Images, and then to the package defaults.
+type Policy struct {
+	// Interval is the delay between two successful polls
+	Interval time.Duration `json:"interval,omitempty"`
+	// Jitter is the upper bound of the random delay added to each poll, a negative value disables it
+	Jitter time.Duration `json:"jitter,omitempty"`
+	// MaxFailures is the number of consecutive failed polls before the watcher was torn down
+	MaxFailures int `json:"maxFailures,omitempty"`
+	// Backoff is the delay after the first failed poll, it doubles after each following failure
+	Backoff time.Duration `json:"backoff,omitempty"`
+	// MaxBackoff caps the delay between the retries
+	MaxBackoff time.Duration `json:"maxBackoff,omitempty"`
+	// IdleTimeout expires the image once no watcher has been attached for that long,
+	// the zero value never expires an idle image
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
+}
+
+// Merge returns a copy of p whose zero fields were filled by d
+func (p Policy) Merge(d Policy) Policy {
+	if p.Interval == 0 {
+		p.Interval = d.Interval
+	}
+	if p.Jitter == 0 {
+		p.Jitter = d.Jitter
+	}
+	if p.MaxFailures == 0 {
+		p.MaxFailures = d.MaxFailures
+	}
+	if p.Backoff == 0 {
+		p.Backoff = d.Backoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = d.MaxBackoff
+	}
+	if p.IdleTimeout == 0 {
+		p.IdleTimeout = d.IdleTimeout
+	}
+	return p
+}
+
+func (p Policy) interval() time.Duration {
+	if p.Interval <= 0 {
+		return defaultInterval
+	}
+	return p.Interval
+}
+
+func (p Policy) jitter() time.Duration {
+	switch {
+	case p.Jitter < 0:
+		return 0
+	case p.Jitter == 0:
+		return randDuration(defaultJitter)
+	default:
+		return randDuration(p.Jitter)
+	}
+}
+
+func (p Policy) maxFailures() int {
+	if p.MaxFailures <= 0 {
+		return defaultMaxFailures
+	}
+	return p.MaxFailures
+}
+
+func (p Policy) backoff(failures int) time.Duration {
+	d, max := p.Backoff, p.MaxBackoff
+	if d <= 0 {
+		d = defaultBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	for n := 1; n < failures && d < max; n++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	jitterRand.Lock()
+	defer jitterRand.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
 type RequestHandler func(projectName string, repositoryName string, digestOrTag string) (res artifact.Artifact, err error)
 
+// ListHandler lists all the artifacts inside the repository, it was used for refreshing
+// all the watched tags of the same repository with a single request
+type ListHandler func(projectName string, repositoryName string) (res []artifact.Artifact, err error)
+
+// DigestHandler resolves only the digest of the tag, such as by the manifest HEAD of the registry, which was much
+// cheaper than the RequestHandler. It receives the etag it returned last, and returns an empty digest if the tag
+// was not modified since then.
+type DigestHandler func(projectName string, repositoryName string, tag string, etag string) (digest string, newEtag string, err error)
+
 type Images interface {
 	Image(opt Option) (Image, error)
+	// ListWatches returns the status of all the active watches sorted by the image name
+	ListWatches() []WatchStatus
+	// Follow attaches a watcher to the active watch of the image name, it returns an error if the image was not
+	// watched instead of starting a new watch. The followers were neither counted as the watchers nor keep
+	// the image from Policy.IdleTimeout, their ResultChan was closed once the image was torn down.
+	Follow(name string) (watch.Interface, error)
+	// Unwatch stops polling the image and closes all of its watchers
+	Unwatch(name string) error
+	Stats() ImagesStats
+	// Close shuts down all the watches, and waits for the scheduler and the workers to exit
+	Close(ctx context.Context) error
+}
+
+// WatchStatus describes an active watch of Images
+type WatchStatus struct {
+	Name     string
+	Option   Option
+	Digest   string
+	LastPoll time.Time
+	NextPoll time.Time
+	Failures int
+	Watchers int
+	// Followers were attached by Images.Follow, they were not counted in Watchers
+	Followers int
 }
 
+// ImagesStats contains the counters of Images
+type ImagesStats struct {
+	Watches  int
+	Watchers int
+	Queued   int
+	Workers  int
+	Polls    int64
+	Errors   int64
+}
+
+// ImagesConfig contains the defaults shared by all the images inside Images
+type ImagesConfig struct {
+	// Policy was merged into the Policy of each Option
+	Policy Policy
+	// Clock was used for scheduling the polls, it defaults to the real clock
+	Clock clock.Clock
+	// Workers is the number of the goroutines calling the RequestHandler concurrently
+	Workers int
+	// ListHandler enables the batch polling, the due images of the same repository were refreshed
+	// together by one ListHandler call instead of one RequestHandler call per image
+	ListHandler ListHandler
+	// DigestHandler polls every image before the RequestHandler, which was only called once it failed.
+	// It takes the place of the ListHandler, since it doesn't touch the database of harbor.
+	// The images selecting a platform were still polled by the RequestHandler.
+	DigestHandler DigestHandler
+}
+
+// images polls all the watched images from a single scheduler goroutine.
+// The scheduler pops the due images from a priority queue keyed on the next poll time,
+// and hands them over to a bounded pool of workers which push them back after polling.
 type images struct {
 	mu sync.Mutex
 
-	images      map[string]Image
-	removedChan chan string
+	images map[string]*image
+	queue  imageQueue
+	wake   chan struct{}
+	jobs   chan []*image
+	// queued was broadcast under mu once an image was pushed back into the queue or removed
+	queued *sync.Cond
 
 	handler RequestHandler
+	list    ListHandler
+	digest  DigestHandler
+	policy  Policy
+	clock   clock.Clock
+	workers int
 
+	polls  int64
+	errors int64
+
+	wg     sync.WaitGroup
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
 func NewImages(ctx context.Context, handler RequestHandler) Images {
+	return NewImagesWithConfig(ctx, handler, ImagesConfig{})
+}
+
+func NewImagesWithConfig(ctx context.Context, handler RequestHandler, c ImagesConfig) Images {
+	if c.Clock == nil {
+		c.Clock = clock.RealClock{}
+	}
+	if c.Workers <= 0 {
+		c.Workers = defaultWorkers
+	}
 	subCtx, cancel := context.WithCancel(ctx)
 	i := &images{
-		images:      make(map[string]Image, 0),
-		removedChan: make(chan string, maxRemovedChan),
-		handler:     handler,
-		ctx:         subCtx,
-		cancel:      cancel,
+		images:  make(map[string]*image, 0),
+		queue:   make(imageQueue, 0),
+		wake:    make(chan struct{}, 1),
+		jobs:    make(chan []*image),
+		handler: handler,
+		list:    c.ListHandler,
+		digest:  c.DigestHandler,
+		policy:  c.Policy,
+		clock:   c.Clock,
+		workers: c.Workers,
+		ctx:     subCtx,
+		cancel:  cancel,
+	}
+	i.queued = sync.NewCond(&i.mu)
+	i.wg.Add(c.Workers + 1)
+	for n := 0; n < c.Workers; n++ {
+		go i.worker()
 	}
 	go i.Loop()
 	return i
 }
 
+// Loop is the scheduler, it dispatches the due images to the workers
 func (images *images) Loop() {
+	defer images.wg.Done()
 	for {
-		select {
-		case name := <-images.removedChan:
-			images.mu.Lock()
-			t, ok := images.images[name]
-			if !ok {
-				images.mu.Unlock()
-				continue
+		due, wait := images.due()
+		for _, batch := range due {
+			select {
+			case images.jobs <- batch:
+			case <-images.ctx.Done():
 			}
-			delete(images.images, name)
-			images.mu.Unlock()
-			t.Shutdown()
+		}
+		if len(due) > 0 {
+			continue
+		}
+		timer := images.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-images.wake:
+		case <-images.ctx.Done():
+			timer.Stop()
+			images.shutdown()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// due pops all the images whose next poll time has come,
+// and returns how long the scheduler could sleep if there was none.
+// With batch polling, a due image brings along the queued images of the same repository
+// which were due within batchWindow, the images backing off after a failure keep their own schedule.
+func (images *images) due() (res [][]*image, wait time.Duration) {
+	images.mu.Lock()
+	defer images.mu.Unlock()
+	now := images.clock.Now()
+	for images.queue.Len() > 0 {
+		next := images.queue[0]
+		if next.next.After(now) {
+			return res, next.next.Sub(now)
+		}
+		heap.Pop(&images.queue)
+		if next.ctx.Err() != nil {
+			continue
+		}
+		batch := []*image{next}
+		if images.list != nil && images.digest == nil {
+			batch = append(batch, images.popRepository(next.opt.RepositoryName(), now.Add(batchWindow))...)
+		}
+		res = append(res, batch)
+	}
+	return res, maxSchedulerIdle
+}
+
+// popRepository removes the queued images of the repository which were due before until from the queue,
+// except the ones backing off after a failure
+func (images *images) popRepository(repositoryName string, until time.Time) (res []*image) {
+	for k := 0; k < images.queue.Len(); {
+		i := images.queue[k]
+		if i.ctx.Err() != nil || i.opt.RepositoryName() != repositoryName || i.next.After(until) || i.backingOff() {
+			k++
+			continue
+		}
+		heap.Remove(&images.queue, k)
+		res = append(res, i)
+		// heap.Remove moves another image into k, so k stays unchanged
+	}
+	return res
+}
+
+func (images *images) worker() {
+	defer images.wg.Done()
+	for {
+		select {
 		case <-images.ctx.Done():
-			for _, v := range images.images {
-				v.Shutdown()
+			return
+		case batch := <-images.jobs:
+			live := batch[:0]
+			for _, i := range batch {
+				if !images.expire(i) {
+					live = append(live, i)
+				}
 			}
+			switch len(live) {
+			case 0:
+			case 1:
+				images.poll(live[0])
+			default:
+				images.pollRepository(live)
+			}
+		}
+	}
+}
+
+// expire tears down the image if Option.ExpiredTime has passed
+// or no watcher has been attached within Policy.IdleTimeout
+func (images *images) expire(i *image) bool {
+	now := images.clock.Now()
+	var message string
+	switch {
+	case i.opt.ExpiredTime > 0 && !now.Before(time.Unix(i.opt.ExpiredTime, 0)):
+		message = fmt.Sprintf(ErrorImageWatchExpired, i.opt.ImageName())
+	case i.opt.Policy.IdleTimeout > 0 && now.Sub(i.idleSince(now)) >= i.opt.Policy.IdleTimeout:
+		message = fmt.Sprintf(ErrorImageWatchIdle, i.opt.ImageName(), i.opt.Policy.IdleTimeout)
+	default:
+		return false
+	}
+	zaplogger.Sugar().Infow("image watch expired", "image", i.opt.ImageName(), "reason", message)
+	i.action(watch.Error, NewExpiredStatus(message))
+	images.remove(i)
+	return true
+}
+
+func (images *images) poll(i *image) {
+	// the DigestHandler only resolves the digest of the index, which can't select the platform
+	if images.digest != nil && i.platform == nil {
+		digest, etag, err := images.digest(i.opt.Project, i.opt.Repository, i.opt.Tag, i.etag)
+		if err == nil {
+			i.etag = etag
+			res := artifact.Artifact{}
+			res.Digest = digest
+			images.apply(i, res, nil)
+			return
+		}
+		// the RequestHandler decides whether the tag was deleted or the poll failed
+		zaplogger.Sugar().Debugw("image digest poll failed, falling back", "image", i.opt.ImageName(), "err", err)
+		i.etag = ""
+	}
+	res, err := images.handler(i.opt.Project, i.opt.Repository, i.opt.Tag)
+	images.apply(i, res, err)
+}
+
+// pollRepository refreshes all the images of one repository with a single ListHandler call.
+// The images whose tag was not in the listed page fall back to the RequestHandler.
+func (images *images) pollRepository(batch []*image) {
+	list, err := images.list(batch[0].opt.Project, batch[0].opt.Repository)
+	if err != nil {
+		for _, i := range batch {
+			images.apply(i, artifact.Artifact{}, err)
+		}
+		return
+	}
+	refs := make(map[string]artifact.Artifact, len(list))
+	for _, a := range list {
+		refs[a.Digest] = a
+		for _, t := range a.Tags {
+			refs[t.Name] = a
+		}
+	}
+	for _, i := range batch {
+		if a, ok := refs[i.opt.Tag]; ok {
+			images.apply(i, a, nil)
+			continue
+		}
+		images.poll(i)
+	}
+}
+
+// apply handles the result of polling the image, and schedules its next poll
+func (images *images) apply(i *image, res artifact.Artifact, err error) {
+	atomic.AddInt64(&images.polls, 1)
+	if err == nil && i.platform != nil {
+		res.Digest, err = PlatformDigest(res, *i.platform)
+	}
+	if err != nil {
+		atomic.AddInt64(&images.errors, 1)
+		if i.handleError(err) {
+			images.remove(i)
 			return
 		}
+		images.schedule(i, i.opt.Policy.backoff(i.failures)+i.opt.Policy.jitter())
+		return
+	}
+	// opt and failures were only written by the polling worker, the lock publishes them to ListWatches,
+	// and keeps the digest consistent with the initial events of the watchers attaching concurrently
+	i.mu.Lock()
+	i.lastPoll = images.clock.Now()
+	i.failures = 0
+	if i.opt.Sha256 == "" && res.Digest != "" {
+		i.opt.Sha256 = res.Digest
+		close(i.resolved)
+	}
+	// a caller-supplied Sha256 was authoritative, so the first poll already reports the difference
+	if i.opt.Sha256 != "" && res.Digest != "" && res.Digest != i.opt.Sha256 {
+		previous := i.opt.Sha256
+		i.opt.Sha256 = res.Digest
+		if i.ctx.Err() == nil {
+			i.broadcasters.Action(watch.Modified, NewImageDigestChange(i.opt, previous))
+		}
+	}
+	i.mu.Unlock()
+	images.schedule(i, i.opt.Policy.interval()+i.opt.Policy.jitter())
+}
+
+// schedule pushes the image back into the queue, and wakes up the scheduler
+func (images *images) schedule(i *image, d time.Duration) {
+	images.mu.Lock()
+	defer images.mu.Unlock()
+	if i.ctx.Err() != nil {
+		return
+	}
+	i.next = images.clock.Now().Add(d)
+	if i.opt.ExpiredTime > 0 {
+		if expiry := time.Unix(i.opt.ExpiredTime, 0); expiry.Before(i.next) {
+			i.next = expiry
+		}
+	}
+	heap.Push(&images.queue, i)
+	images.queued.Broadcast()
+	select {
+	case images.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (images *images) remove(i *image) {
+	images.mu.Lock()
+	if t, ok := images.images[i.opt.ImageName()]; ok && t == i {
+		delete(images.images, i.opt.ImageName())
+	}
+	if i.index >= 0 {
+		heap.Remove(&images.queue, i.index)
+	}
+	images.queued.Broadcast()
+	images.mu.Unlock()
+	i.Shutdown()
+}
+
+func (images *images) shutdown() {
+	images.mu.Lock()
+	all := make([]*image, 0, len(images.images))
+	for k, v := range images.images {
+		all = append(all, v)
+		delete(images.images, k)
+	}
+	for _, v := range images.queue {
+		v.index = -1
+	}
+	images.queue = images.queue[:0]
+	images.queued.Broadcast()
+	images.mu.Unlock()
+	for _, v := range all {
+		v.Shutdown()
 	}
 }
 
 func (images *images) Image(opt Option) (Image, error) {
 	images.mu.Lock()
 	defer images.mu.Unlock()
-	if t, ok := images.images[opt.ImageName()]; ok {
-		return t, nil
-	} else {
-		i, err := NewImage(images.ctx, opt, images.removedChan, images.handler)
+	if images.ctx.Err() != nil {
+		return nil, images.ctx.Err()
+	}
+	var platform *Platform
+	if opt.Platform != "" {
+		p, err := ParsePlatform(opt.Platform)
 		if err != nil {
 			return nil, err
 		}
-		images.images[opt.ImageName()] = i
-		return i, nil
+		platform = &p
+		opt.Platform = p.String()
+	}
+	if t, ok := images.images[opt.ImageName()]; ok && t.ctx.Err() == nil {
+		return t, nil
+	}
+	// todo: is it necessary to check whether the harbor image was existed?
+	opt.Policy = opt.Policy.Merge(images.policy)
+	subCtx, cancel := context.WithCancel(images.ctx)
+	i := &image{
+		opt:          opt,
+		platform:     platform,
+		broadcasters: watch.NewBroadcaster(maxQueuedEvents, watch.DropIfChannelFull),
+		resolved:     make(chan struct{}),
+		detached:     images.clock.Now(),
+		clock:        images.clock,
+		index:        -1,
+		next:         images.clock.Now().Add(opt.Policy.interval() + opt.Policy.jitter()),
+		ctx:          subCtx,
+		cancel:       cancel,
+	}
+	if opt.ExpiredTime > 0 {
+		if expiry := time.Unix(opt.ExpiredTime, 0); expiry.Before(i.next) {
+			i.next = expiry
+		}
+	}
+	if opt.Sha256 != "" {
+		close(i.resolved)
+	}
+	images.images[opt.ImageName()] = i
+	heap.Push(&images.queue, i)
+	select {
+	case images.wake <- struct{}{}:
+	default:
+	}
+	return i, nil
+}
+
+func (images *images) ListWatches() []WatchStatus {
+	images.mu.Lock()
+	defer images.mu.Unlock()
+	res := make([]WatchStatus, 0, len(images.images))
+	for k, i := range images.images {
+		st := WatchStatus{Name: k}
+		if i.index >= 0 {
+			st.NextPoll = i.next
+		}
+		i.mu.Lock()
+		st.Option = i.opt
+		st.Digest = i.opt.Sha256
+		st.LastPoll = i.lastPoll
+		st.Failures = i.failures
+		st.Watchers = i.watchers
+		st.Followers = i.followers
+		i.mu.Unlock()
+		res = append(res, st)
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Name < res[b].Name
+	})
+	return res
+}
+
+func (images *images) Follow(name string) (watch.Interface, error) {
+	images.mu.Lock()
+	i, ok := images.images[name]
+	images.mu.Unlock()
+	if !ok || i.ctx.Err() != nil {
+		return nil, fmt.Errorf(ErrorImageWatchNotExisted, name)
+	}
+	return i.follow(), nil
+}
+
+func (images *images) Unwatch(name string) error {
+	images.mu.Lock()
+	i, ok := images.images[name]
+	images.mu.Unlock()
+	if !ok {
+		return fmt.Errorf(ErrorImageWatchNotExisted, name)
+	}
+	images.remove(i)
+	return nil
+}
+
+func (images *images) Stats() ImagesStats {
+	images.mu.Lock()
+	defer images.mu.Unlock()
+	res := ImagesStats{
+		Watches: len(images.images),
+		Queued:  images.queue.Len(),
+		Workers: images.workers,
+		Polls:   atomic.LoadInt64(&images.polls),
+		Errors:  atomic.LoadInt64(&images.errors),
+	}
+	for _, i := range images.images {
+		i.mu.Lock()
+		res.Watchers += i.watchers
+		i.mu.Unlock()
+	}
+	return res
+}
+
+func (images *images) Close(ctx context.Context) error {
+	images.cancel()
+	done := make(chan struct{})
+	go func() {
+		images.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 type Image interface {
 	Watch() watch.Interface
+	// WatchWithInitialEvents sends a synthetic watch.Added with the current Option to the new watcher,
+	// once the digest was resolved, before any following event
+	WatchWithInitialEvents() watch.Interface
+	// WatchFromWithInitialEvents combines WatchFrom and WatchWithInitialEvents: the initial event was
+	// a watch.Modified from the digest if the image was known to differ from it, or else a watch.Added.
+	// An empty digest was the same as WatchWithInitialEvents.
+	WatchFromWithInitialEvents(sha256 string) watch.Interface
+	// WatchFrom resumes from the last digest seen by the caller. If the image was already known to differ,
+	// the new watcher receives a watch.Modified first; if the image was not resolved yet, the digest
+	// becomes its starting point and the first poll reports a watch.Modified when harbor differs.
+	// An empty digest was the same as Watch.
+	WatchFrom(sha256 string) watch.Interface
 	Shutdown()
 }
 
 type image struct {
 	once sync.Once
+	mu   sync.Mutex
 
+	// opt, failures and lastPoll were only written by the worker which is polling the image under mu
 	opt          Option
-	handler      RequestHandler
 	broadcasters *watch.Broadcaster
+	failures     int
+	lastPoll     time.Time
+	// etag was returned by the DigestHandler last, it was only accessed by the polling worker
+	etag string
+	// platform was parsed from opt.Platform, the digest of its manifest was watched instead of the tag
+	platform *Platform
+	// resolved was closed once opt.Sha256 was known
+	resolved chan struct{}
+
+	// watchers, followers and detached were guarded by mu, detached is when the last watcher was stopped
+	watchers  int
+	followers int
+	detached  time.Time
+	clock     clock.Clock
+
+	// next and index were guarded by the mutex of images
+	next  time.Time
+	index int
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func NewImage(ctx context.Context, opt Option, removedChan chan<- string, handler RequestHandler) (Image, error) {
-	// todo: is it necessary to check whether the harbor image was existed?
-	subCtx, cancel := context.WithCancel(ctx)
-	i := &image{
-		opt:          opt,
-		handler:      handler,
-		broadcasters: watch.NewBroadcaster(maxQueuedEvents, watch.DropIfChannelFull),
-		ctx:          subCtx,
-		cancel:       cancel,
+// backingOff returns true if the last poll of the image failed
+func (i *image) backingOff() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.failures > 0
+}
+
+// handleError reports the failed poll to the watchers,
+// and returns true if the image should be torn down
+func (i *image) handleError(err error) bool {
+	if IsNotFound(err) {
+		zaplogger.Sugar().Infow("image was deleted", "image", i.opt.ImageName(), "err", err)
+		i.action(watch.Deleted, i.current())
+		return true
 	}
-	go i.Loop(removedChan)
-	return i, nil
+	i.mu.Lock()
+	i.lastPoll = i.clock.Now()
+	i.failures++
+	i.mu.Unlock()
+	zaplogger.Sugar().Errorw("image poll failed", "image", i.opt.ImageName(), "failures", i.failures, "err", err)
+	i.action(watch.Error, NewErrorStatus(err))
+	return i.failures >= i.opt.Policy.maxFailures()
+}
+
+// action broadcasts the event unless the image has already been shut down
+func (i *image) action(action watch.EventType, obj runtime.Object) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ctx.Err() != nil {
+		return
+	}
+	i.broadcasters.Action(action, obj)
+}
+
+func (i *image) Watch() watch.Interface {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ctx.Err() != nil {
+		return watch.NewEmptyWatch()
+	}
+	i.watchers++
+	return &subscriber{Interface: i.broadcasters.Watch(), image: i}
+}
+
+func (i *image) WatchWithInitialEvents() watch.Interface {
+	return i.WatchFromWithInitialEvents("")
 }
 
-func (i *image) Loop(removedChan chan<- string) {
-	defer i.Shutdown()
-	tick := time.NewTicker(time.Millisecond * loopTickTimeInMs)
-	defer tick.Stop()
+func (i *image) WatchFromWithInitialEvents(sha256 string) watch.Interface {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ctx.Err() != nil {
+		return watch.NewEmptyWatch()
+	}
+	i.watchers++
+	if i.opt.Sha256 == "" && sha256 != "" {
+		i.opt.Sha256 = sha256
+		close(i.resolved)
+	}
+	switch {
+	case i.opt.Sha256 == "":
+		return &subscriber{Interface: newInitialWatcher(i.broadcasters.Watch(), i.resolved, i.current), image: i}
+	case sha256 == "" || sha256 == i.opt.Sha256:
+		w := i.broadcasters.WatchWithPrefix([]watch.Event{{Type: watch.Added, Object: NewImageDigestChange(i.opt, "")}})
+		return &subscriber{Interface: w, image: i}
+	default:
+		w := i.broadcasters.WatchWithPrefix([]watch.Event{{Type: watch.Modified, Object: NewImageDigestChange(i.opt, sha256)}})
+		return &subscriber{Interface: w, image: i}
+	}
+}
+
+func (i *image) WatchFrom(sha256 string) watch.Interface {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ctx.Err() != nil {
+		return watch.NewEmptyWatch()
+	}
+	i.watchers++
+	switch {
+	case sha256 == "" || sha256 == i.opt.Sha256:
+		return &subscriber{Interface: i.broadcasters.Watch(), image: i}
+	case i.opt.Sha256 == "":
+		i.opt.Sha256 = sha256
+		close(i.resolved)
+		return &subscriber{Interface: i.broadcasters.Watch(), image: i}
+	default:
+		w := i.broadcasters.WatchWithPrefix([]watch.Event{{Type: watch.Modified, Object: NewImageDigestChange(i.opt, sha256)}})
+		return &subscriber{Interface: w, image: i}
+	}
+}
+
+// follow attaches a follower, which was not counted by idleSince
+func (i *image) follow() watch.Interface {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ctx.Err() != nil {
+		return watch.NewEmptyWatch()
+	}
+	i.followers++
+	return &subscriber{Interface: i.broadcasters.Watch(), image: i, follower: true}
+}
+
+func (i *image) current() runtime.Object {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return NewImageDigestChange(i.opt, "")
+}
+
+// idleSince returns when the image became idle, or now if there was any watcher attached
+func (i *image) idleSince(now time.Time) time.Time {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.watchers > 0 {
+		return now
+	}
+	return i.detached
+}
+
+// subscriber counts the attached watchers and followers of the image
+type subscriber struct {
+	watch.Interface
+	once     sync.Once
+	image    *image
+	follower bool
+}
+
+func (s *subscriber) Stop() {
+	s.once.Do(func() {
+		s.image.mu.Lock()
+		if s.follower {
+			s.image.followers--
+		} else {
+			s.image.watchers--
+			s.image.detached = s.image.clock.Now()
+		}
+		s.image.mu.Unlock()
+		s.Interface.Stop()
+	})
+}
+
+// Shutdown stops polling the image and closes all of its watchers,
+// the scheduler drops the image the next time it was popped from the queue
+func (i *image) Shutdown() {
+	i.once.Do(func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.cancel()
+		i.broadcasters.Shutdown()
+	})
+}
+
+// initialWatcher forwards the events of a watcher attached before the digest was resolved,
+// and inserts the watch.Added in front of them as soon as the digest was resolved
+type initialWatcher struct {
+	w      watch.Interface
+	result chan watch.Event
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func newInitialWatcher(w watch.Interface, resolved <-chan struct{}, current func() runtime.Object) watch.Interface {
+	iw := &initialWatcher{
+		w:      w,
+		result: make(chan watch.Event, maxQueuedEvents),
+		stop:   make(chan struct{}),
+	}
+	go iw.loop(resolved, current)
+	return iw
+}
+
+func (iw *initialWatcher) loop(resolved <-chan struct{}, current func() runtime.Object) {
+	defer close(iw.result)
+	in := iw.w.ResultChan()
+	added := func() bool {
+		select {
+		case <-resolved:
+		default:
+			return true
+		}
+		resolved = nil
+		return iw.send(watch.Event{Type: watch.Added, Object: current()})
+	}
 	for {
 		select {
-		case <-i.ctx.Done():
-			return
-		case <-tick.C:
-			rand.Seed(time.Now().UnixNano())
-			time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
-			res, err := i.handler(i.opt.Project, i.opt.Repository, i.opt.Tag)
-			if err != nil {
-				// todo check whether the error was like `{"code":404,"message":"resource: xxxxx not found"}`
-				zaplogger.Sugar().Error(err)
-				select {
-				case removedChan <- i.opt.ImageName():
-					zaplogger.Sugar().Infof("Loop send removedChan:%s success", i.opt.ImageName())
-				case <-time.After(time.Second * 1):
-					zaplogger.Sugar().Infof("Loop send removedChan:%s timout", i.opt.ImageName())
-				}
-				continue
+		case <-resolved:
+			if !added() {
+				return
+			}
+		case e, ok := <-in:
+			if !ok {
+				return
 			}
-			if i.opt.Sha256 == "" && res.Digest != "" {
-				i.opt.Sha256 = res.Digest
+			if resolved != nil && !added() {
+				return
 			}
-			if i.opt.Sha256 != "" && res.Digest != i.opt.Sha256 {
-				i.opt.Sha256 = res.Digest
-				i.broadcasters.Action(watch.Modified, i.opt)
+			if !iw.send(e) {
+				return
 			}
+		case <-iw.stop:
+			return
 		}
 	}
 }
 
-func (i *image) Watch() watch.Interface {
-	return i.broadcasters.Watch()
+func (iw *initialWatcher) send(e watch.Event) bool {
+	select {
+	case iw.result <- e:
+		return true
+	case <-iw.stop:
+		return false
+	}
 }
 
-func (i *image) Shutdown() {
-	i.once.Do(func() {
-		i.cancel()
-		i.broadcasters.Shutdown()
+func (iw *initialWatcher) ResultChan() <-chan watch.Event {
+	return iw.result
+}
+
+func (iw *initialWatcher) Stop() {
+	iw.once.Do(func() {
+		close(iw.stop)
+		iw.w.Stop()
 	})
 }
 
+// NewExpiredStatus returns the metav1.Status which was sent with the final watch.Error of an expired image
+func NewExpiredStatus(message string) *metav1.Status {
+	return &metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusGone,
+		Reason:  metav1.StatusReasonExpired,
+		Message: message,
+	}
+}
+
+// NewErrorStatus converts the error into a metav1.Status which would be sent with watch.Error
+func NewErrorStatus(err error) *metav1.Status {
+	s := &metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusInternalServerError,
+		Reason:  metav1.StatusReasonInternalError,
+		Message: err.Error(),
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		s.Code = int32(se.Code)
+		switch se.Code {
+		case http.StatusNotFound:
+			s.Reason = metav1.StatusReasonNotFound
+		case http.StatusUnauthorized:
+			s.Reason = metav1.StatusReasonUnauthorized
+		case http.StatusForbidden:
+			s.Reason = metav1.StatusReasonForbidden
+		case http.StatusTooManyRequests:
+			s.Reason = metav1.StatusReasonTooManyRequests
+		case http.StatusServiceUnavailable:
+			s.Reason = metav1.StatusReasonServiceUnavailable
+		default:
+			s.Reason = metav1.StatusReasonUnknown
+		}
+	}
+	return s
+}
+
 // image: harbor.domain.com/helix-saga/go-all:latest
 // imageID: docker-pullable://harbor.domain.com/helix-saga/go-all@sha256:27d6aa8f9d040c5e85c61a093ad2dc769e57440e8240c3294f47093e97d96c9a
+//
+// Deprecated: use ParseReference(s).Digest instead, which also validates the reference
 func GetHashFromDockerImageId(s string) string {
-	t := strings.Split(s, "@")
-	if len(t) != 2 {
+	ref, err := ParseReference(s)
+	if err != nil {
 		return ""
 	}
-	return t[1]
+	return ref.Digest
 }
@@ -1,7 +1,17 @@
 package harbor_api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/goharbor/harbor/src/controller/artifact"
+	"github.com/goharbor/harbor/src/controller/tag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -64,3 +74,812 @@ func TestGetHashFromDockerImageId(t *testing.T) {
 		})
 	}
 }
+
+func TestImage_Loop_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		policy  Policy
+		want    []watch.EventType
+		wantMax int
+	}{
+		{
+			name: "TestImage_Loop_Errors_NotFound",
+			err:  &StatusError{Code: http.StatusNotFound, Body: `{"errors":[{"code":"NOT_FOUND"}]}`},
+			policy: Policy{
+				Interval: time.Millisecond * 10,
+				Jitter:   -1,
+			},
+			want: []watch.EventType{watch.Deleted},
+		},
+		{
+			name: "TestImage_Loop_Errors_Transient",
+			err:  &StatusError{Code: http.StatusServiceUnavailable},
+			policy: Policy{
+				Interval:    time.Millisecond * 10,
+				Jitter:      -1,
+				MaxFailures: 2,
+				Backoff:     time.Millisecond * 10,
+			},
+			want: []watch.EventType{watch.Error, watch.Error},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+				return artifact.Artifact{}, tt.err
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{})
+			i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest", Policy: tt.policy})
+			if err != nil {
+				t.Fatalf("Images.Image() error = %v", err)
+			}
+			w := i.Watch()
+			got := make([]watch.EventType, 0)
+			for e := range w.ResultChan() {
+				got = append(got, e.Type)
+				if e.Type == watch.Error {
+					if s, ok := e.Object.(*metav1.Status); !ok || s.Code != http.StatusServiceUnavailable {
+						t.Errorf("watch.Error object = %v, want *metav1.Status with code 503", e.Object)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+			if n := imgs.(*images).len(); n != 0 {
+				t.Errorf("len(images) = %v, want 0 after the watcher was torn down", n)
+			}
+		})
+	}
+}
+
+func TestPolicy_backoff(t *testing.T) {
+	p := Policy{Backoff: time.Second, MaxBackoff: time.Second * 5}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: time.Second},
+		{failures: 2, want: time.Second * 2},
+		{failures: 3, want: time.Second * 4},
+		{failures: 4, want: time.Second * 5},
+		{failures: 10, want: time.Second * 5},
+	}
+	for _, tt := range tests {
+		if got := p.backoff(tt.failures); got != tt.want {
+			t.Errorf("Policy.backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestImages_FakeClock(t *testing.T) {
+	digests := []string{"sha256:a", "sha256:a", "sha256:b"}
+	polled := make(chan struct{}, len(digests))
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		res := artifact.Artifact{}
+		res.Digest = digests[0]
+		if len(digests) > 1 {
+			digests = digests[1:]
+		}
+		polled <- struct{}{}
+		return res, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy: Policy{Interval: time.Second * 30, Jitter: -1},
+		Clock:  fc,
+	})
+	i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest", Policy: Policy{Interval: time.Second * 2}})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := i.Watch()
+	defer w.Stop()
+	for n := 0; n < 3; n++ {
+		waitQueued(imgs)
+		fc.Step(time.Second)
+		select {
+		case <-polled:
+			t.Fatalf("poll %d happened before the interval of the Option", n)
+		case <-time.After(time.Millisecond * 20):
+		}
+		fc.Step(time.Second)
+		<-polled
+	}
+	select {
+	case e := <-w.ResultChan():
+		if e.Type != watch.Modified || e.Object.(*ImageDigestChange).Spec.Sha256 != "sha256:b" {
+			t.Errorf("event = %v, want Modified with sha256:b", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no Modified event after the digest changed")
+	}
+}
+
+func TestPolicy_Merge(t *testing.T) {
+	d := Policy{Interval: time.Second * 30, Jitter: time.Second, MaxFailures: 3, Backoff: time.Second, MaxBackoff: time.Minute}
+	got := Policy{Interval: time.Second * 2, Jitter: -1}.Merge(d)
+	want := Policy{Interval: time.Second * 2, Jitter: -1, MaxFailures: 3, Backoff: time.Second, MaxBackoff: time.Minute}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Policy.Merge() = %v, want %v", got, want)
+	}
+}
+
+func (images *images) len() int {
+	images.mu.Lock()
+	defer images.mu.Unlock()
+	return len(images.images)
+}
+
+// waitQueued blocks until all the due images were polled and pushed back into the queue by the workers
+func waitQueued(imgs Images) {
+	images := imgs.(*images)
+	images.mu.Lock()
+	defer images.mu.Unlock()
+	for images.queue.Len() != len(images.images) ||
+		images.queue.Len() > 0 && !images.queue[0].next.After(images.clock.Now()) {
+		images.queued.Wait()
+	}
+}
+
+func TestImages_Scheduler(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		polls  = make(map[string]int)
+		active int
+		peak   int
+	)
+	// the polls were held until released by the test, so that both workers were busy at once
+	started, release := make(chan struct{}, 20), make(chan struct{})
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		mu.Lock()
+		polls[digestOrTag]++
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		active--
+		mu.Unlock()
+		res := artifact.Artifact{}
+		res.Digest = "sha256:" + digestOrTag
+		return res, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy:  Policy{Interval: time.Second, Jitter: -1},
+		Clock:   fc,
+		Workers: 2,
+	})
+	for n := 0; n < 20; n++ {
+		if _, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: fmt.Sprintf("tag-%d", n)}); err != nil {
+			t.Fatalf("Images.Image() error = %v", err)
+		}
+	}
+	for n := 0; n < 3; n++ {
+		waitQueued(imgs)
+		fc.Step(time.Second)
+		// a poll was released only once another one has started, a third worker would have started meanwhile
+		for k := 0; k < 20; k++ {
+			<-started
+			if k > 0 {
+				release <- struct{}{}
+			}
+		}
+		release <- struct{}{}
+	}
+	waitQueued(imgs)
+	mu.Lock()
+	defer mu.Unlock()
+	if peak != 2 {
+		t.Errorf("concurrent polls = %v, want %v workers", peak, 2)
+	}
+	for n := 0; n < 20; n++ {
+		if got := polls[fmt.Sprintf("tag-%d", n)]; got != 3 {
+			t.Errorf("polls of tag-%d = %v, want %v", n, got, 3)
+		}
+	}
+}
+
+func TestImages_BatchPolling(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		requested = make(map[string]int)
+		listed    int
+	)
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		requested[digestOrTag]++
+		res := artifact.Artifact{}
+		res.Digest = "sha256:" + digestOrTag
+		return res, nil
+	}
+	list := func(projectName string, repositoryName string) ([]artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		listed++
+		res := make([]artifact.Artifact, 0)
+		for n := 0; n < 10; n++ {
+			a := artifact.Artifact{}
+			a.Digest = fmt.Sprintf("sha256:tag-%d", n)
+			a.Tags = []*tag.Tag{{}}
+			a.Tags[0].Name = fmt.Sprintf("tag-%d", n)
+			res = append(res, a)
+		}
+		return res, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy:      Policy{Interval: time.Second, Jitter: -1},
+		Clock:       fc,
+		ListHandler: list,
+	})
+	// tag-10 was not in the listed page, so it falls back to the RequestHandler
+	for n := 0; n <= 10; n++ {
+		if _, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: fmt.Sprintf("tag-%d", n)}); err != nil {
+			t.Fatalf("Images.Image() error = %v", err)
+		}
+	}
+	for n := 0; n < 3; n++ {
+		waitQueued(imgs)
+		fc.Step(time.Second)
+	}
+	waitQueued(imgs)
+	mu.Lock()
+	defer mu.Unlock()
+	if listed != 3 {
+		t.Errorf("ListHandler calls = %v, want %v", listed, 3)
+	}
+	want := map[string]int{"tag-10": 3}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("RequestHandler calls = %v, want %v", requested, want)
+	}
+}
+
+func TestImages_BatchPolling_Intervals(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		requested = make(map[string]int)
+		listed    int
+	)
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		requested[digestOrTag]++
+		if digestOrTag == "failing" {
+			return artifact.Artifact{}, errors.New("harbor unavailable")
+		}
+		res := artifact.Artifact{}
+		res.Digest = "sha256:" + digestOrTag
+		return res, nil
+	}
+	list := func(projectName string, repositoryName string) ([]artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		listed++
+		res := make([]artifact.Artifact, 0)
+		for _, v := range []string{"fast", "slow"} {
+			a := artifact.Artifact{}
+			a.Digest = "sha256:" + v
+			a.Tags = []*tag.Tag{{}}
+			a.Tags[0].Name = v
+			res = append(res, a)
+		}
+		return res, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy:      Policy{Interval: time.Second, Jitter: -1, MaxFailures: 100},
+		Clock:       fc,
+		ListHandler: list,
+	})
+	// the failing tag was not in the listed page, and backs off for 10s after its first failure
+	for _, opt := range []Option{
+		{Project: "p", Repository: "r", Tag: "fast"},
+		{Project: "p", Repository: "r", Tag: "slow", Policy: Policy{Interval: time.Hour}},
+		{Project: "p", Repository: "r", Tag: "failing", Policy: Policy{Backoff: time.Second * 10}},
+	} {
+		if _, err := imgs.Image(opt); err != nil {
+			t.Fatalf("Images.Image() error = %v", err)
+		}
+	}
+	for n := 0; n < 5; n++ {
+		waitQueued(imgs)
+		fc.Step(time.Second)
+	}
+	waitQueued(imgs)
+	mu.Lock()
+	defer mu.Unlock()
+	// only the first poll batched the fast and the failing tags, the slow one was not due within the window
+	if listed != 1 {
+		t.Errorf("ListHandler calls = %v, want %v", listed, 1)
+	}
+	want := map[string]int{"fast": 4, "failing": 1}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("RequestHandler calls = %v, want %v", requested, want)
+	}
+}
+
+func TestImages_DigestPolling(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		requested = make(map[string]int)
+		etags     = make([]string, 0)
+		listed    int
+	)
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		requested[digestOrTag]++
+		res := artifact.Artifact{}
+		res.Digest = "sha256:" + digestOrTag
+		return res, nil
+	}
+	list := func(projectName string, repositoryName string) ([]artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		listed++
+		return nil, nil
+	}
+	digest := func(projectName string, repositoryName string, tag string, etag string) (string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if tag == "broken" {
+			return "", "", errors.New("registry unavailable")
+		}
+		etags = append(etags, etag)
+		if etag == `"sha256:a"` {
+			return "", etag, nil
+		}
+		return "sha256:a", `"sha256:a"`, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy:        Policy{Interval: time.Second, Jitter: -1},
+		Clock:         fc,
+		ListHandler:   list,
+		DigestHandler: digest,
+	})
+	i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "a"})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	if _, err = imgs.Image(Option{Project: "p", Repository: "r", Tag: "broken"}); err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := i.WatchWithInitialEvents()
+	defer w.Stop()
+	for n := 0; n < 3; n++ {
+		waitQueued(imgs)
+		fc.Step(time.Second)
+	}
+	waitQueued(imgs)
+	select {
+	case e := <-w.ResultChan():
+		if e.Type != watch.Added || e.Object.(*ImageDigestChange).Spec.Sha256 != "sha256:a" {
+			t.Errorf("event = %v, want Added with sha256:a", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no Added event from the DigestHandler")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"", `"sha256:a"`, `"sha256:a"`}; !reflect.DeepEqual(etags, want) {
+		t.Errorf("DigestHandler etags = %v, want %v", etags, want)
+	}
+	// the failed DigestHandler falls back to the RequestHandler, and the ListHandler was not used
+	if want := map[string]int{"broken": 3}; !reflect.DeepEqual(requested, want) || listed != 0 {
+		t.Errorf("RequestHandler calls = %v ListHandler calls = %v, want %v and none", requested, listed, want)
+	}
+	if status := imgs.ListWatches(); len(status) != 2 || status[0].Digest != "sha256:a" || status[0].Failures != 0 {
+		t.Errorf("Images.ListWatches() = %+v", status)
+	}
+}
+
+func TestImages_Expire(t *testing.T) {
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		res := artifact.Artifact{}
+		res.Digest = "sha256:a"
+		return res, nil
+	}
+	now := time.Unix(1600000000, 0)
+	fc := clock.NewFakeClock(now)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy: Policy{Interval: time.Second, Jitter: -1, IdleTimeout: time.Second * 3},
+		Clock:  fc,
+	})
+
+	expired, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "expired", ExpiredTime: now.Unix() + 2})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := expired.Watch()
+	idle, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "idle"})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	idle.Watch().Stop()
+
+	for n := 0; n < 2; n++ {
+		waitQueued(imgs)
+		fc.Step(time.Second)
+	}
+	e, ok := <-w.ResultChan()
+	if s, isStatus := e.Object.(*metav1.Status); !ok || e.Type != watch.Error || !isStatus || s.Reason != metav1.StatusReasonExpired {
+		t.Errorf("event = %v, want watch.Error with the Expired reason", e)
+	}
+	if _, ok = <-w.ResultChan(); ok {
+		t.Errorf("ResultChan was not closed after the watch expired")
+	}
+	if n := imgs.(*images).len(); n != 1 {
+		t.Errorf("len(images) = %v, want %v", n, 1)
+	}
+
+	for n := 0; n < 2; n++ {
+		waitQueued(imgs)
+		fc.Step(time.Second)
+	}
+	waitQueued(imgs)
+	if n := imgs.(*images).len(); n != 0 {
+		t.Errorf("len(images) = %v, want 0 after the idle image expired", n)
+	}
+}
+
+func TestImages_Expire_BeforeFirstPoll(t *testing.T) {
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		return artifact.Artifact{}, errors.New("the image was not polled")
+	}
+	now := time.Unix(1600000000, 0)
+	fc := clock.NewFakeClock(now)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy: Policy{Interval: time.Hour, Jitter: -1},
+		Clock:  fc,
+	})
+	i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest", ExpiredTime: now.Unix() + 2})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := i.Watch()
+	defer w.Stop()
+	// the watch expires at ExpiredTime instead of the first poll an interval later
+	fc.Step(time.Second * 2)
+	e, ok := <-w.ResultChan()
+	if s, isStatus := e.Object.(*metav1.Status); !ok || e.Type != watch.Error || !isStatus || s.Reason != metav1.StatusReasonExpired {
+		t.Errorf("event = %v, want watch.Error with the Expired reason", e)
+	}
+}
+
+func TestImages_Management(t *testing.T) {
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		res := artifact.Artifact{}
+		res.Digest = "sha256:" + digestOrTag
+		return res, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	imgs := NewImagesWithConfig(context.Background(), handler, ImagesConfig{
+		Policy:  Policy{Interval: time.Second, Jitter: -1},
+		Clock:   fc,
+		Workers: 3,
+	})
+	for _, tag := range []string{"b", "a", "c"} {
+		if _, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: tag}); err != nil {
+			t.Fatalf("Images.Image() error = %v", err)
+		}
+	}
+	i, _ := imgs.Image(Option{Project: "p", Repository: "r", Tag: "a"})
+	w := i.Watch()
+	waitQueued(imgs)
+	fc.Step(time.Second)
+	waitQueued(imgs)
+
+	list := imgs.ListWatches()
+	names := make([]string, 0)
+	for _, v := range list {
+		names = append(names, v.Name)
+	}
+	if want := []string{"p/r:a", "p/r:b", "p/r:c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListWatches() names = %v, want %v", names, want)
+	}
+	if list[0].Digest != "sha256:a" || list[0].Watchers != 1 || !list[0].LastPoll.Equal(fc.Now()) {
+		t.Errorf("ListWatches()[0] = %+v, want digest sha256:a, 1 watcher and polled now", list[0])
+	}
+
+	if err := imgs.Unwatch("p/r:a"); err != nil {
+		t.Errorf("Unwatch() error = %v", err)
+	}
+	if _, ok := <-w.ResultChan(); ok {
+		t.Errorf("ResultChan was not closed after Unwatch")
+	}
+	if err := imgs.Unwatch("p/r:a"); err == nil {
+		t.Errorf("Unwatch() of a removed image error = nil, want error")
+	}
+
+	stats := imgs.Stats()
+	want := ImagesStats{Watches: 2, Watchers: 0, Queued: 2, Workers: 3, Polls: 3}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := imgs.Close(ctx); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if n := len(imgs.ListWatches()); n != 0 {
+		t.Errorf("len(ListWatches()) = %v after Close, want 0", n)
+	}
+	if _, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "a"}); err == nil {
+		t.Errorf("Images.Image() after Close error = nil, want error")
+	}
+}
+
+func TestImages_Follow(t *testing.T) {
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		res := artifact.Artifact{}
+		res.Digest = "sha256:a"
+		return res, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy: Policy{Interval: time.Second, Jitter: -1, IdleTimeout: time.Second * 3},
+		Clock:  fc,
+	})
+	if _, err := imgs.Follow("p/r:latest"); err == nil {
+		t.Errorf("Images.Follow() of an unwatched image error = nil, want error")
+	}
+	i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest"})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	w := i.Watch()
+	followers := make([]watch.Interface, 2)
+	for n := range followers {
+		if followers[n], err = imgs.Follow("p/r:latest"); err != nil {
+			t.Fatalf("Images.Follow() error = %v", err)
+		}
+	}
+	if list := imgs.ListWatches(); len(list) != 1 || list[0].Watchers != 1 || list[0].Followers != 2 {
+		t.Errorf("ListWatches() = %+v, want 1 watcher and 2 followers", list)
+	}
+	if stats := imgs.Stats(); stats.Watchers != 1 {
+		t.Errorf("Stats().Watchers = %v, want %v", stats.Watchers, 1)
+	}
+
+	// the followers don't keep the image from expiring once the watcher left
+	w.Stop()
+	fc.Step(time.Second * 3)
+	for _, f := range followers {
+		e, ok := <-f.ResultChan()
+		if s, isStatus := e.Object.(*metav1.Status); !ok || e.Type != watch.Error || !isStatus || s.Reason != metav1.StatusReasonExpired {
+			t.Errorf("event = %v, want watch.Error with the Expired reason", e)
+		}
+		if _, ok = <-f.ResultChan(); ok {
+			t.Errorf("ResultChan was not closed after the watch expired")
+		}
+		f.Stop()
+	}
+	if _, err = imgs.Follow("p/r:latest"); err == nil {
+		t.Errorf("Images.Follow() of an expired image error = nil, want error")
+	}
+}
+
+func TestImage_WatchWithInitialEvents(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		digests = []string{"sha256:a", "sha256:b"}
+	)
+	handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		res := artifact.Artifact{}
+		res.Digest = digests[0]
+		if len(digests) > 1 {
+			digests = digests[1:]
+		}
+		return res, nil
+	}
+	fc := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+		Policy: Policy{Interval: time.Second, Jitter: -1},
+		Clock:  fc,
+	})
+	i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest"})
+	if err != nil {
+		t.Fatalf("Images.Image() error = %v", err)
+	}
+	next := func(w watch.Interface) watch.Event {
+		select {
+		case e := <-w.ResultChan():
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("no event within 1 second")
+		}
+		return watch.Event{}
+	}
+
+	// attached before the digest was resolved
+	early := i.WatchWithInitialEvents()
+	defer early.Stop()
+	select {
+	case e := <-early.ResultChan():
+		t.Fatalf("event = %v before the digest was resolved", e)
+	case <-time.After(time.Millisecond * 20):
+	}
+	waitQueued(imgs)
+	fc.Step(time.Second)
+	if e := next(early); e.Type != watch.Added || e.Object.(*ImageDigestChange).Spec.Sha256 != "sha256:a" {
+		t.Errorf("event = %v, want Added with sha256:a", e)
+	}
+
+	// attached after the digest was resolved
+	waitQueued(imgs)
+	late := i.WatchWithInitialEvents()
+	defer late.Stop()
+	if e := next(late); e.Type != watch.Added || e.Object.(*ImageDigestChange).Spec.Sha256 != "sha256:a" {
+		t.Errorf("event = %v, want Added with sha256:a", e)
+	}
+
+	fc.Step(time.Second)
+	for _, w := range []watch.Interface{early, late} {
+		if e := next(w); e.Type != watch.Modified || e.Object.(*ImageDigestChange).Spec.Sha256 != "sha256:b" {
+			t.Errorf("event = %v, want Modified with sha256:b", e)
+		}
+	}
+}
+
+func TestImage_WatchFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		seed     string
+		resume   string
+		digests  []string
+		want     []string
+		wantLast string
+	}{
+		{
+			name:     "TestImage_WatchFrom_ChangedWhileDown",
+			resume:   "sha256:old",
+			digests:  []string{"sha256:new", "sha256:new"},
+			want:     []string{"sha256:new"},
+			wantLast: "sha256:new",
+		},
+		{
+			name:     "TestImage_WatchFrom_Unchanged",
+			resume:   "sha256:old",
+			digests:  []string{"sha256:old", "sha256:old"},
+			want:     []string{},
+			wantLast: "sha256:old",
+		},
+		{
+			name:     "TestImage_WatchFrom_EmptyDigestIgnored",
+			resume:   "sha256:old",
+			digests:  []string{"", "sha256:old"},
+			want:     []string{},
+			wantLast: "sha256:old",
+		},
+		{
+			name:     "TestImage_WatchFrom_AlreadyResolved",
+			seed:     "sha256:new",
+			resume:   "sha256:old",
+			digests:  []string{"sha256:new", "sha256:new"},
+			want:     []string{"sha256:new"},
+			wantLast: "sha256:new",
+		},
+		{
+			name:     "TestImage_WatchFrom_Empty",
+			digests:  []string{"sha256:a", "sha256:b"},
+			want:     []string{"sha256:b"},
+			wantLast: "sha256:b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			digests := tt.digests
+			handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				res := artifact.Artifact{}
+				res.Digest = digests[0]
+				digests = digests[1:]
+				return res, nil
+			}
+			fc := clock.NewFakeClock(time.Now())
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+				Policy: Policy{Interval: time.Second, Jitter: -1},
+				Clock:  fc,
+			})
+			i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest", Sha256: tt.seed})
+			if err != nil {
+				t.Fatalf("Images.Image() error = %v", err)
+			}
+			w := i.WatchFrom(tt.resume)
+			for range tt.digests {
+				waitQueued(imgs)
+				fc.Step(time.Second)
+			}
+			waitQueued(imgs)
+			w.Stop()
+			got := make([]string, 0)
+			for e := range w.ResultChan() {
+				if e.Type != watch.Modified {
+					t.Errorf("event type = %v, want %v", e.Type, watch.Modified)
+				}
+				got = append(got, e.Object.(*ImageDigestChange).Spec.Sha256)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Modified digests = %v, want %v", got, tt.want)
+			}
+			if last := imgs.ListWatches()[0].Digest; last != tt.wantLast {
+				t.Errorf("digest = %v, want %v", last, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestImage_WatchFromWithInitialEvents(t *testing.T) {
+	tests := []struct {
+		name         string
+		seed         string
+		resume       string
+		wantType     watch.EventType
+		wantSha256   string
+		wantPrevious string
+	}{
+		{name: "TestImage_WatchFromWithInitialEvents_Changed", seed: "sha256:new", resume: "sha256:old", wantType: watch.Modified, wantSha256: "sha256:new", wantPrevious: "sha256:old"},
+		{name: "TestImage_WatchFromWithInitialEvents_Unchanged", seed: "sha256:new", resume: "sha256:new", wantType: watch.Added, wantSha256: "sha256:new"},
+		{name: "TestImage_WatchFromWithInitialEvents_Unresolved", resume: "sha256:old", wantType: watch.Added, wantSha256: "sha256:old"},
+		{name: "TestImage_WatchFromWithInitialEvents_Empty", seed: "sha256:new", wantType: watch.Added, wantSha256: "sha256:new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(projectName string, repositoryName string, digestOrTag string) (artifact.Artifact, error) {
+				return artifact.Artifact{}, errors.New("the image was not polled")
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			imgs := NewImagesWithConfig(ctx, handler, ImagesConfig{
+				Policy: Policy{Interval: time.Minute, Jitter: -1},
+				Clock:  clock.NewFakeClock(time.Now()),
+			})
+			i, err := imgs.Image(Option{Project: "p", Repository: "r", Tag: "latest", Sha256: tt.seed})
+			if err != nil {
+				t.Fatalf("Images.Image() error = %v", err)
+			}
+			w := i.WatchFromWithInitialEvents(tt.resume)
+			defer w.Stop()
+			e := <-w.ResultChan()
+			c, ok := e.Object.(*ImageDigestChange)
+			if e.Type != tt.wantType || !ok || c.Spec.Sha256 != tt.wantSha256 || c.Spec.PreviousSha256 != tt.wantPrevious {
+				t.Errorf("initial event = %v %+v, want %v %v from %v", e.Type, e.Object, tt.wantType, tt.wantSha256, tt.wantPrevious)
+			}
+		})
+	}
+}